@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/admin"
+	"github.com/SparkPost/httpdump/storage/bolt"
+	"github.com/SparkPost/httpdump/storage/filelog"
+	"github.com/SparkPost/httpdump/storage/pg"
+	"github.com/SparkPost/httpdump/storage/sqlite3"
+)
+
+// backendFlags selects and configures a storage backend.
+type backendFlags struct {
+	kind           string
+	pgURL          string
+	pgSchema       string
+	pgBatchSize    int
+	pgNotify       bool
+	pgPartition    string
+	pgAhead        int
+	pgMaxConns     int
+	pgMaxIdle      int
+	pgConnLifetime time.Duration
+	sqliteRotate   string
+	sqlitePath     string
+	sqliteMaintain time.Duration
+	sqliteBusy     time.Duration
+	sqliteLayout   string
+	sqliteLocal    bool
+	sqliteFileMB   int64
+	sqliteRows     int64
+	sqliteAge      time.Duration
+	sqliteArchive  string
+	sqliteMaxMB    int64
+	filelogDir     string
+	filelogSync    string
+	boltPath       string
+	retain         time.Duration
+}
+
+func addBackendFlags(fs *flag.FlagSet) *backendFlags {
+	bf := &backendFlags{}
+	fs.StringVar(&bf.kind, "backend", "pg", "storage backend: pg, sqlite3, filelog or bolt")
+	fs.StringVar(&bf.pgURL, "pg-url", "", "PostgreSQL connection URL (default: built from POSTGRESQL_* and PG* env vars)")
+	fs.IntVar(&bf.pgMaxConns, "pg-max-conns", 0, "most open PostgreSQL connections (default: no limit)")
+	fs.IntVar(&bf.pgMaxIdle, "pg-max-idle", 0, "most idle PostgreSQL connections (default: 2)")
+	fs.DurationVar(&bf.pgConnLifetime, "pg-conn-lifetime", 0, "close PostgreSQL connections after this long (default: never)")
+	fs.StringVar(&bf.pgSchema, "pg-schema", envOr("POSTGRESQL_SCHEMA", "request_dump"), "PostgreSQL schema")
+	fs.StringVar(&bf.pgPartition, "pg-partition", "", "partition PostgreSQL requests by arrival: day or month (requires -retain)")
+	fs.IntVar(&bf.pgAhead, "pg-partition-ahead", 7, "how many future PostgreSQL partitions to create in advance (at least 1)")
+	fs.BoolVar(&bf.pgNotify, "pg-notify", false, "announce stored PostgreSQL requests with NOTIFY, so serve processes them right away")
+	fs.IntVar(&bf.pgBatchSize, "pg-batch-size", 0, "most requests in each PostgreSQL batch, so several workers can share the backlog (default: no limit)")
+	fs.StringVar(&bf.sqliteRotate, "sqlite-rotate", "hour", "SQLite file rotation: day, hour, minute, size or memory, or a single file ending in .db")
+	fs.StringVar(&bf.sqliteLayout, "sqlite-layout", "", "name rotated SQLite files with this Go time layout, starting a new file when the name changes")
+	fs.BoolVar(&bf.sqliteLocal, "sqlite-local", false, "name time-rotated SQLite files in the local time zone instead of UTC")
+	fs.Int64Var(&bf.sqliteFileMB, "sqlite-max-file-mb", 0, "with -sqlite-rotate size, start a new file once it's this many MB")
+	fs.Int64Var(&bf.sqliteRows, "sqlite-max-rows", 0, "with -sqlite-rotate size, start a new file once it has this many requests")
+	fs.DurationVar(&bf.sqliteAge, "sqlite-max-age", 0, "with -sqlite-rotate size, start a new file once it's this old")
+	fs.StringVar(&bf.sqlitePath, "sqlite-path", ".", "directory for SQLite database files")
+	fs.DurationVar(&bf.sqliteBusy, "sqlite-busy-timeout", sqlite3.DefaultOptions.BusyTimeout, "how long to wait for another SQLite connection's lock before retrying")
+	fs.DurationVar(&bf.sqliteMaintain, "sqlite-maintain", 10*time.Minute, "with serve, how often to expire processed SQLite files, vacuum, and check -sqlite-max-mb (0: never)")
+	fs.StringVar(&bf.sqliteArchive, "sqlite-archive", "", "move expired SQLite files to this directory instead of deleting them")
+	fs.Int64Var(&bf.sqliteMaxMB, "sqlite-max-mb", 0, "disk budget for -sqlite-path, in MB; new requests are refused while it's exceeded (default: no limit)")
+	fs.StringVar(&bf.filelogDir, "filelog-dir", "httpdump-log", "directory for log segments")
+	fs.StringVar(&bf.filelogSync, "filelog-sync", "interval", "log fsync policy: always, interval, batch or never")
+	fs.StringVar(&bf.boltPath, "bolt-path", "httpdump.bolt", "bbolt database file")
+	fs.DurationVar(&bf.retain, "retain", 0, "keep processed requests for this long instead of deleting them (pg and sqlite3 only)")
+	return bf
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// open connects to the configured backend. If initSchema is set, PostgreSQL tables
+// are created if necessary; the other backends always initialize themselves.
+func (bf *backendFlags) open(initSchema bool) (storage.DumpBatcher, error) {
+	if bf.retain > 0 && bf.kind != "pg" && bf.kind != "sqlite3" {
+		return nil, fmt.Errorf("backend [%s] doesn't support -retain", bf.kind)
+	}
+	switch bf.kind {
+	case "pg":
+		pgcfg := &pg.PGConfig{
+			Url:             bf.pgURL,
+			Db:              os.Getenv("POSTGRESQL_DB"),
+			User:            os.Getenv("POSTGRESQL_USER"),
+			Pass:            os.Getenv("POSTGRESQL_PASS"),
+			MaxOpenConns:    bf.pgMaxConns,
+			MaxIdleConns:    bf.pgMaxIdle,
+			ConnMaxLifetime: bf.pgConnLifetime,
+		}
+		if err := pgcfg.LoadEnv(); err != nil {
+			return nil, err
+		}
+		if pgcfg.SSLMode == "" {
+			pgcfg.SSLMode = "disable"
+		}
+		dsn, err := pgcfg.DSN()
+		if err != nil {
+			return nil, err
+		}
+		dbh, err := pgcfg.Connect()
+		if err != nil {
+			return nil, err
+		}
+		var partitioning *pg.Partitioning
+		if bf.pgPartition != "" {
+			if bf.retain <= 0 {
+				dbh.Close()
+				return nil, fmt.Errorf("-pg-partition requires -retain, so old partitions are dropped")
+			}
+			partitioning = &pg.Partitioning{Interval: bf.pgPartition, Ahead: bf.pgAhead}
+			if err = partitioning.Validate(); err != nil {
+				dbh.Close()
+				return nil, err
+			}
+		}
+		if initSchema {
+			if partitioning != nil {
+				err = pg.SchemaInitPartitioned(dbh, bf.pgSchema, partitioning)
+			} else {
+				err = pg.SchemaInit(dbh, bf.pgSchema)
+			}
+			if err != nil {
+				dbh.Close()
+				return nil, err
+			}
+		}
+		retry := pg.DefaultRetryPolicy
+		return &pg.PgDumper{
+			Schema:       bf.pgSchema,
+			Dbh:          dbh,
+			DSN:          dsn,
+			BatchSize:    bf.pgBatchSize,
+			Retain:       bf.retain > 0,
+			Partitioning: partitioning,
+			Retry:        &retry,
+			Notify:       bf.pgNotify,
+		}, nil
+
+	case "sqlite3":
+		dateFmt, opts := bf.sqliteOptions()
+		sqld, err := sqlite3.NewDumperOptions(dateFmt, bf.sqlitePath, opts)
+		if err != nil {
+			return nil, err
+		}
+		sqld.Retain = bf.retain > 0
+		return sqld, nil
+
+	case "filelog":
+		return filelog.NewDumper(bf.filelogDir, bf.filelogSync)
+
+	case "bolt":
+		return bolt.NewDumper(bf.boltPath)
+	}
+	return nil, fmt.Errorf("unknown backend [%s]", bf.kind)
+}
+
+// openExisting is open, for subcommands that only look at stored requests. SQLite files
+// are never created or rotated, so it fails if there aren't any.
+func (bf *backendFlags) openExisting() (storage.DumpBatcher, error) {
+	if bf.kind != "sqlite3" {
+		return bf.open(false)
+	}
+	dateFmt, opts := bf.sqliteOptions()
+	sqld, err := sqlite3.OpenExisting(dateFmt, bf.sqlitePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	sqld.Retain = bf.retain > 0
+	return sqld, nil
+}
+
+// sqliteOptions returns the arguments to sqlite3.NewDumperOptions chosen by flags.
+func (bf *backendFlags) sqliteOptions() (string, sqlite3.Options) {
+	opts := sqlite3.DefaultOptions
+	opts.BusyTimeout = bf.sqliteBusy
+	opts.Rotation = bf.rotation()
+	dateFmt := bf.sqliteRotate
+	if opts.Rotation != nil {
+		dateFmt = ""
+	}
+	return dateFmt, opts
+}
+
+// rotation returns the SQLite rotation policy chosen by flags, or nil for one of sqlite3.NewDumper's.
+func (bf *backendFlags) rotation() sqlite3.RotationPolicy {
+	if bf.sqliteRotate == "size" {
+		return sqlite3.SizeRotation{
+			MaxBytes: bf.sqliteFileMB << 20,
+			MaxRows:  bf.sqliteRows,
+			MaxAge:   bf.sqliteAge,
+		}
+	}
+	layout := bf.sqliteLayout
+	if layout == "" && bf.sqliteLocal {
+		layout = sqlite3.DateFormats[bf.sqliteRotate]
+	}
+	if layout == "" {
+		return nil
+	}
+	return sqlite3.TimeRotation{Layout: layout, Local: bf.sqliteLocal}
+}
+
+// maintenance returns how the sqlite3 backend's files are maintained by serve.
+func (bf *backendFlags) maintenance() sqlite3.Maintenance {
+	return sqlite3.Maintenance{
+		Retention:  bf.retain,
+		ArchiveDir: bf.sqliteArchive,
+		MaxBytes:   bf.sqliteMaxMB << 20,
+	}
+}
+
+// inspector opens the configured backend with openExisting, which must implement storage.Inspector.
+func (bf *backendFlags) inspector() (storage.DumpBatcher, storage.Inspector, error) {
+	db, err := bf.openExisting()
+	if err != nil {
+		return nil, nil, err
+	}
+	i, ok := db.(storage.Inspector)
+	if !ok {
+		closeStore(db)
+		return nil, nil, fmt.Errorf("backend [%s] can't list stored requests", bf.kind)
+	}
+	return db, i, nil
+}
+
+// closeStore closes the backend, if it needs closing.
+func closeStore(db storage.DumpBatcher) error {
+	if c, ok := db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// filterFlags selects stored requests, using the same names as the admin API's query parameters.
+type filterFlags map[string]*string
+
+func addFilterFlags(fs *flag.FlagSet) filterFlags {
+	ff := filterFlags{}
+	ff["state"] = fs.String("state", "", "only requests in this state: pending, batched or done")
+	ff["batch"] = fs.String("batch", "", "only requests in this batch")
+	ff["after"] = fs.String("after", "", "only requests received at or after this time (RFC 3339)")
+	ff["before"] = fs.String("before", "", "only requests received before this time (RFC 3339)")
+	ff["min_id"] = fs.String("min-id", "", "only requests with at least this ID")
+	ff["max_id"] = fs.String("max-id", "", "only requests with at most this ID")
+	return ff
+}
+
+func (ff filterFlags) filter() (storage.Filter, error) {
+	q := url.Values{}
+	for name, v := range ff {
+		if *v != "" {
+			q.Set(name, strings.TrimSpace(*v))
+		}
+	}
+	return admin.ParseFilter(q)
+}
+
+// pageSize is how many requests are read at a time when walking through stored requests.
+const pageSize = 500
+
+// eachRequest calls fn for every stored request matching f, in ID order, reading a page at a time.
+func eachRequest(i storage.Inspector, f storage.Filter, fn func(*storage.Request) error) error {
+	for {
+		reqs, err := i.ListRequests(f, 0, pageSize)
+		if err != nil {
+			return err
+		}
+		for j := range reqs {
+			if err = fn(&reqs[j]); err != nil {
+				return err
+			}
+		}
+		if len(reqs) < pageSize {
+			return nil
+		}
+		f.MinID = *reqs[len(reqs)-1].ID + 1
+	}
+}
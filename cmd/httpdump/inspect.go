@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	ff := addFilterFlags(fs)
+	id := fs.Int64("id", 0, "show the request with this ID, including its body")
+	batches := fs.Bool("batches", false, "list batches that aren't done, instead of requests")
+	offset := fs.Int("offset", 0, "skip this many matching requests")
+	limit := fs.Int("limit", 20, "list at most this many requests (0 for no limit)")
+	fs.Parse(args)
+
+	db, i, err := bf.inspector()
+	if err != nil {
+		return err
+	}
+	defer closeStore(db)
+
+	switch {
+	case *id != 0:
+		req, err := i.GetRequest(*id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n%s\n", req.String(), req.Data)
+		return nil
+
+	case *batches:
+		bs, err := i.Batches()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "BATCH\tREQUESTS\tOLDEST\tNEWEST\n")
+		for _, b := range bs {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", b.ID, b.Requests,
+				b.Oldest.Format(time.RFC3339), b.Newest.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	}
+
+	f, err := ff.filter()
+	if err != nil {
+		return err
+	}
+	reqs, err := i.ListRequests(f, *offset, *limit)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tBATCH\tWHEN\tBYTES\tREQUEST\n")
+	for _, req := range reqs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", *req.ID, batchString(&req),
+			req.When.Format(time.RFC3339), len(req.Data), requestLine(&req))
+	}
+	return tw.Flush()
+}
+
+func batchString(req *storage.Request) string {
+	if req.Batch == nil || *req.Batch == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *req.Batch)
+}
+
+// requestLine returns the first line of the stored headers, such as "POST / HTTP/1.1".
+func requestLine(req *storage.Request) string {
+	line := req.Head
+	if n := bytes.IndexByte(line, '\n'); n >= 0 {
+		line = line[:n]
+	}
+	return string(bytes.TrimRight(line, "\r"))
+}
@@ -0,0 +1,69 @@
+// Command httpdump stores incoming HTTP requests, processes them in batches,
+// and inspects or moves stored requests, using any supported storage backend.
+//
+// Usage:
+//
+//	httpdump <command> [flags]
+//
+// Run "httpdump <command> -h" for the flags each command accepts.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// command is one httpdump subcommand. run receives the arguments following the command name.
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":     {"store incoming requests, and process them in batches", runServe},
+	"inspect":   {"list stored requests or batches, or show one request", runInspect},
+	"replay":    {"send stored requests to another server", runReplay},
+	"reprocess": {"put stored requests through batch processing again", runReprocess},
+	"export":    {"write stored requests to a file", runExport},
+	"import":    {"store requests read from a file", runImport},
+	"stats":     {"show how many requests are waiting to be processed", runStats},
+	"migrate":   {"create or update the backend's schema", runMigrate},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for help with a command.\n", os.Args[0])
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-h" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "Unknown command [%s]\n\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		log.SetFlags(0)
+		log.Fatalf("%s: %s", os.Args[1], err)
+	}
+}
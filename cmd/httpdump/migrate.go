@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+// runMigrate creates the backend's schema if it doesn't exist yet.
+// Opening a backend is enough to do this, so it's also done implicitly by serve and import.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	fs.Parse(args)
+
+	db, err := bf.open(true)
+	if err != nil {
+		return err
+	}
+	log.Printf("Schema for backend [%s] is up to date\n", bf.kind)
+	return closeStore(db)
+}
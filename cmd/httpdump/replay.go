@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/SparkPost/httpdump/output/forward"
+	"github.com/SparkPost/httpdump/storage"
+)
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	ff := addFilterFlags(fs)
+	target := fs.String("target", "", "send requests to this URL, such as http://127.0.0.1:8080 (required)")
+	fs.Parse(args)
+
+	if *target == "" {
+		return fmt.Errorf("-target is required")
+	}
+	fwd, err := forward.NewForwarder(*target)
+	if err != nil {
+		return err
+	}
+	f, err := ff.filter()
+	if err != nil {
+		return err
+	}
+
+	db, i, err := bf.inspector()
+	if err != nil {
+		return err
+	}
+	defer closeStore(db)
+
+	// Stored requests are left as they are, so replaying doesn't affect batch processing.
+	n := 0
+	err = eachRequest(i, f, func(req *storage.Request) error {
+		if err := fwd.Send(req); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	log.Printf("Replayed %d requests to %s\n", n, *target)
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/SparkPost/httpdump/output/forward"
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// runReprocess puts matching stored requests, processed ones kept with -retain by default,
+// through batch processing again. Unlike replay, they're moved into new batches,
+// and are marked done again once they've been forwarded. -retain is required, so finishing
+// the new batches doesn't delete the history being reprocessed.
+func runReprocess(args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	ff := addFilterFlags(fs)
+	target := fs.String("forward", "", "process batches by sending requests to this URL (required)")
+	path := fs.String("path", "", "only requests whose path starts with this")
+	batchSize := fs.Int("batch-size", pageSize, "how many requests to put in each new batch")
+	fs.Parse(args)
+
+	if *target == "" {
+		return fmt.Errorf("-forward is required")
+	} else if bf.retain <= 0 {
+		return fmt.Errorf("-retain is required, so reprocessed requests are kept")
+	} else if *batchSize <= 0 {
+		return fmt.Errorf("-batch-size must be positive")
+	}
+	fwd, err := forward.NewForwarder(*target)
+	if err != nil {
+		return err
+	}
+	if *ff["state"] == "" {
+		// Don't take pending or batched requests from a running server.
+		*ff["state"] = "done"
+	}
+	f, err := ff.filter()
+	if err != nil {
+		return err
+	}
+
+	db, err := bf.open(false)
+	if err != nil {
+		return err
+	}
+	defer closeStore(db)
+
+	n, err := storage.Reprocess(db, f, *path, *batchSize, fwd)
+	log.Printf("Reprocessed %d requests through %s\n", n, *target)
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SparkPost/httpdump/output/forward"
+	"github.com/SparkPost/httpdump/server"
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/groupcommit"
+	"github.com/SparkPost/httpdump/storage/pg"
+	"github.com/SparkPost/httpdump/storage/sqlite3"
+)
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	port := fs.Int("port", 80, "port to listen for requests")
+	batchInterval := fs.Int("batch-interval", 10, "how often to process stored requests, in seconds")
+	shutdownTimeout := fs.Int("shutdown-timeout", 30, "how long to wait for in-flight work when stopping, in seconds")
+	target := fs.String("forward", "", "process batches by sending requests to this URL (default: store only)")
+	debounce := fs.Duration("debounce", 0, "with pg, how long to wait after requests arrive before processing them")
+	groupSize := fs.Int("group-size", 0, "store incoming requests in groups of up to this many (default: one at a time)")
+	groupDelay := fs.Duration("group-delay", 5*time.Millisecond, "how long a request waits for others to join its group")
+	leader := fs.Bool("pg-leader", false, "with pg, only process batches while elected leader among servers sharing the schema")
+	groupQueue := fs.Int("group-queue", 1000, "how many requests can wait to be stored before new ones block")
+	fs.Parse(args)
+
+	var processor storage.Processor
+	if *target != "" {
+		fwd, err := forward.NewForwarder(*target)
+		if err != nil {
+			return err
+		}
+		processor = fwd
+	}
+
+	db, err := bf.open(true)
+	if err != nil {
+		return err
+	}
+
+	var elector storage.Elector
+	if *leader {
+		pd, ok := db.(*pg.PgDumper)
+		if !ok {
+			closeStore(db)
+			return fmt.Errorf("-pg-leader requires the pg backend")
+		}
+		elector = &pg.Leader{Dbh: pd.Dbh, Schema: pd.Schema}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Keep rotated SQLite files from piling up.
+	if sqld, ok := db.(*sqlite3.SQLiteDumper); ok && bf.sqliteMaintain > 0 {
+		go sqld.RunMaintenance(ctx, bf.maintenance(), bf.sqliteMaintain)
+	}
+
+	var dumper storage.Dumper
+	if *groupSize > 0 {
+		if dumper, err = groupcommit.NewDumper(db, *groupSize, *groupDelay, *groupQueue); err != nil {
+			closeStore(db)
+			return err
+		}
+	}
+
+	srv := &server.Server{
+		Addr:            fmt.Sprintf(":%d", *port),
+		Store:           db,
+		Dumper:          dumper,
+		Processor:       processor,
+		BatchInterval:   time.Duration(*batchInterval) * time.Second,
+		Debounce:        *debounce,
+		ShutdownTimeout: time.Duration(*shutdownTimeout) * time.Second,
+		AdminToken:      os.Getenv("ADMIN_TOKEN"),
+		Retention:       bf.retain,
+		Elector:         elector,
+	}
+	return srv.Run(ctx)
+}
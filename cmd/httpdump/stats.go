@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	fs.Parse(args)
+
+	db, err := bf.openExisting()
+	if err != nil {
+		return err
+	}
+	defer closeStore(db)
+
+	b, ok := db.(storage.Backlogger)
+	if !ok {
+		return fmt.Errorf("backend [%s] doesn't report its backlog", bf.kind)
+	}
+	pending, oldest, err := b.Backlog()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Unprocessed requests:\t%d\n", pending)
+	if pending > 0 && !oldest.IsZero() {
+		fmt.Printf("Oldest unprocessed:\t%s (%s ago)\n",
+			oldest.Format(time.RFC3339), time.Since(oldest).Truncate(time.Second))
+	}
+
+	if i, ok := db.(storage.Inspector); ok {
+		batches, err := i.Batches()
+		if err != nil {
+			return err
+		}
+		var batched int64
+		for _, b := range batches {
+			batched += b.Requests
+		}
+		fmt.Printf("Open batches:\t\t%d (%d requests)\n", len(batches), batched)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/SparkPost/httpdump/format/har"
+	"github.com/SparkPost/httpdump/format/ndjson"
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// runExport writes matching requests as an NDJSON archive, or as a HAR file.
+// With -drain, it archives pending requests batch by batch instead, marking them done.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	ff := addFilterFlags(fs)
+	out := fs.String("o", "-", "file to write, or - for stdout")
+	format := fs.String("format", "ndjson", "file format: ndjson or har")
+	compress := fs.Bool("gzip", false, "gzip-compress ndjson output")
+	drain := fs.Bool("drain", false, "archive pending requests in batches, marking them done (ndjson only, ignores filters)")
+	fs.Parse(args)
+
+	if *format != "ndjson" && *format != "har" {
+		return fmt.Errorf("unknown format [%s]", *format)
+	} else if *drain && *format != "ndjson" {
+		return fmt.Errorf("-drain requires -format ndjson")
+	} else if *compress && *format != "ndjson" {
+		return fmt.Errorf("-gzip requires -format ndjson")
+	}
+	f, err := ff.filter()
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	var file *os.File
+	if *out != "-" {
+		file, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *drain {
+		db, err := bf.open(false)
+		if err != nil {
+			return err
+		}
+		defer closeStore(db)
+		aw := ndjson.NewWriter(w, *compress)
+		if file != nil {
+			// Each batch must be on disk before it's marked done, since it's gone from db after that.
+			aw.Sync = file.Sync
+		}
+		n, err := ndjson.Export(db, aw)
+		log.Printf("Exported %d requests\n", n)
+		if err != nil {
+			return err
+		}
+		return closeFile(file)
+	}
+
+	db, i, err := bf.inspector()
+	if err != nil {
+		return err
+	}
+	defer closeStore(db)
+
+	var write func(*storage.Request) error
+	var finish func() error
+	bw := bufio.NewWriter(w)
+	if *format == "har" {
+		hw := har.NewWriter(bw)
+		write = hw.Write
+		finish = func() error {
+			if err := hw.Close(); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+	} else {
+		aw := ndjson.NewWriter(w, *compress)
+		write, finish = aw.Write, aw.Close
+	}
+
+	n := 0
+	err = eachRequest(i, f, func(req *storage.Request) error {
+		n++
+		return write(req)
+	})
+	if err != nil {
+		return err
+	}
+	if err = finish(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d requests\n", n)
+	return closeFile(file)
+}
+
+// closeFile closes file, if it's set, reporting errors that surface only once it's closed.
+// The deferred Close afterwards is then a no-op.
+func closeFile(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+	return file.Close()
+}
+
+// runImport stores requests from an archive written by runExport, or entries from any HAR file.
+// They're assigned new IDs, and are pending, whatever their batch was when they were exported.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	bf := addBackendFlags(fs)
+	in := fs.String("i", "-", "file to read, or - for stdin")
+	format := fs.String("format", "ndjson", "file format: ndjson (plain or gzipped) or har")
+	fs.Parse(args)
+
+	var load func(io.Reader, storage.Dumper) (int, error)
+	switch *format {
+	case "ndjson":
+		load = ndjson.Import
+	case "har":
+		load = har.Import
+	default:
+		return fmt.Errorf("unknown format [%s]", *format)
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	db, err := bf.open(true)
+	if err != nil {
+		return err
+	}
+	defer closeStore(db)
+
+	n, err := load(bufio.NewReader(r), db)
+	log.Printf("Imported %d requests\n", n)
+	return err
+}
@@ -0,0 +1,316 @@
+// Package har converts stored requests to and from HTTP Archive (HAR) 1.2 files,
+// which can be opened in browser developer tools and other HTTP tooling.
+//
+// Stored requests have no responses, so exported entries carry an empty response.
+// Bodies that aren't valid UTF-8 are base64-encoded, and marked with the custom
+// "_encoding" field on postData, which Read understands.
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// Version is the HAR format version written by Writer.
+const Version = "1.2"
+
+// creatorVersion identifies this package's output in the HAR creator field.
+const creatorVersion = "1"
+
+// HAR is the top-level object in a HAR file.
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         Timings   `json:"timings"`
+	// ID and Batch record where the entry came from, and are ignored by Read.
+	ID    int64 `json:"_id,omitempty"`
+	Batch int64 `json:"_batch,omitempty"`
+}
+
+type Request struct {
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	HTTPVersion string    `json:"httpVersion"`
+	Cookies     []NameVal `json:"cookies"`
+	Headers     []NameVal `json:"headers"`
+	QueryString []NameVal `json:"queryString"`
+	PostData    *PostData `json:"postData,omitempty"`
+	HeadersSize int       `json:"headersSize"`
+	BodySize    int       `json:"bodySize"`
+}
+
+type NameVal struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string    `json:"mimeType"`
+	Params   []NameVal `json:"params"`
+	Text     string    `json:"text"`
+	Encoding string    `json:"_encoding,omitempty"`
+}
+
+type Response struct {
+	Status      int       `json:"status"`
+	StatusText  string    `json:"statusText"`
+	HTTPVersion string    `json:"httpVersion"`
+	Cookies     []NameVal `json:"cookies"`
+	Headers     []NameVal `json:"headers"`
+	Content     Content   `json:"content"`
+	RedirectURL string    `json:"redirectURL"`
+	HeadersSize int       `json:"headersSize"`
+	BodySize    int       `json:"bodySize"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// NewEntry converts a stored request to a HAR entry.
+func NewEntry(req *storage.Request) (*Entry, error) {
+	r, err := req.HTTPRequest()
+	if err != nil {
+		return nil, fmt.Errorf("har.NewEntry: %s", err)
+	}
+
+	u := *r.URL
+	u.Scheme = "http"
+	u.Host = r.Host
+
+	e := &Entry{
+		StartedDateTime: req.When,
+		Request: Request{
+			Method:      r.Method,
+			URL:         u.String(),
+			HTTPVersion: r.Proto,
+			Cookies:     []NameVal{},
+			Headers:     []NameVal{{Name: "Host", Value: r.Host}},
+			QueryString: []NameVal{},
+			HeadersSize: len(req.Head),
+			BodySize:    len(req.Data),
+		},
+		Response: Response{
+			Cookies:     []NameVal{},
+			Headers:     []NameVal{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	if req.ID != nil {
+		e.ID = *req.ID
+	}
+	if req.Batch != nil {
+		e.Batch = int64(*req.Batch)
+	}
+
+	for _, c := range r.Cookies() {
+		e.Request.Cookies = append(e.Request.Cookies, NameVal{Name: c.Name, Value: c.Value})
+	}
+	e.Request.Headers = append(e.Request.Headers, sorted(r.Header)...)
+	e.Request.QueryString = append(e.Request.QueryString, sorted(r.URL.Query())...)
+
+	if len(req.Data) > 0 {
+		pd := &PostData{MimeType: r.Header.Get("Content-Type"), Params: []NameVal{}}
+		if utf8.Valid(req.Data) {
+			pd.Text = string(req.Data)
+		} else {
+			pd.Text = base64.StdEncoding.EncodeToString(req.Data)
+			pd.Encoding = "base64"
+		}
+		e.Request.PostData = pd
+	}
+	return e, nil
+}
+
+// sorted flattens a header or query map into name/value pairs, ordered by name.
+func sorted(m map[string][]string) []NameVal {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nvs := make([]NameVal, 0, len(m))
+	for _, name := range names {
+		for _, v := range m[name] {
+			nvs = append(nvs, NameVal{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+// StorageRequest converts a HAR entry back to a request suitable for storage.Dumper.
+func (e *Entry) StorageRequest() (*storage.Request, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("har.StorageRequest: %s", err)
+	}
+	proto := e.Request.HTTPVersion
+	if proto != "HTTP/1.0" && proto != "HTTP/1.1" {
+		// Browsers record "http/2.0", "HTTP/2", "h3" and so on here; stored heads must parse as HTTP/1.x.
+		proto = "HTTP/1.1"
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s %s\r\n", e.Request.Method, u.RequestURI(), proto)
+	hasHost := false
+	for _, h := range e.Request.Headers {
+		// Pseudo-headers from HTTP/2 captures, and framing headers, don't belong in an HTTP/1.x head.
+		name := strings.ToLower(h.Name)
+		if strings.HasPrefix(name, ":") || name == "content-length" || name == "transfer-encoding" {
+			continue
+		}
+		if name == "host" {
+			hasHost = true
+		}
+		fmt.Fprintf(&head, "%s: %s\r\n", h.Name, h.Value)
+	}
+	if !hasHost && u.Host != "" {
+		fmt.Fprintf(&head, "Host: %s\r\n", u.Host)
+	}
+
+	req := &storage.Request{When: e.StartedDateTime}
+	if pd := e.Request.PostData; pd != nil {
+		if pd.Encoding == "base64" {
+			if req.Data, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+				return nil, fmt.Errorf("har.StorageRequest: %s", err)
+			}
+		} else if pd.Text != "" {
+			req.Data = []byte(pd.Text)
+		} else if len(pd.Params) > 0 {
+			form := url.Values{}
+			for _, p := range pd.Params {
+				form.Add(p.Name, p.Value)
+			}
+			req.Data = []byte(form.Encode())
+		}
+	}
+	if len(req.Data) > 0 {
+		fmt.Fprintf(&head, "Content-Length: %d\r\n", len(req.Data))
+	}
+	head.WriteString("\r\n")
+	req.Head = head.Bytes()
+	return req, nil
+}
+
+// Writer streams entries to a HAR file, so exports don't need to fit in memory.
+type Writer struct {
+	w     io.Writer
+	n     int
+	err   error
+	begun bool
+}
+
+// NewWriter returns a Writer that writes a HAR document to w. Close must be called to finish it.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (hw *Writer) begin() {
+	if hw.begun || hw.err != nil {
+		return
+	}
+	hw.begun = true
+	creator, _ := json.Marshal(Creator{Name: "httpdump", Version: creatorVersion})
+	_, hw.err = fmt.Fprintf(hw.w, "{\"log\":{\"version\":%q,\"creator\":%s,\"entries\":[\n", Version, creator)
+}
+
+// Write appends one stored request to the document.
+func (hw *Writer) Write(req *storage.Request) error {
+	hw.begin()
+	if hw.err != nil {
+		return hw.err
+	}
+	e, err := NewEntry(req)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if hw.n > 0 {
+		if _, hw.err = io.WriteString(hw.w, ",\n"); hw.err != nil {
+			return hw.err
+		}
+	}
+	_, hw.err = hw.w.Write(buf)
+	hw.n++
+	return hw.err
+}
+
+// Close finishes the document. It doesn't close the underlying io.Writer.
+func (hw *Writer) Close() error {
+	hw.begin()
+	if hw.err != nil {
+		return hw.err
+	}
+	_, hw.err = io.WriteString(hw.w, "\n]}}\n")
+	return hw.err
+}
+
+// Read decodes a HAR document, and calls fn with each entry converted to a storage.Request.
+func Read(r io.Reader, fn func(*storage.Request) error) error {
+	doc := &HAR{}
+	if err := json.NewDecoder(r).Decode(doc); err != nil {
+		return fmt.Errorf("har.Read: %s", err)
+	}
+	for i := range doc.Log.Entries {
+		req, err := doc.Log.Entries[i].StorageRequest()
+		if err != nil {
+			return err
+		}
+		if err = fn(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import stores every entry in a HAR document with d, returning how many were stored.
+func Import(r io.Reader, d storage.Dumper) (int, error) {
+	n := 0
+	err := Read(r, func(req *storage.Request) error {
+		if err := d.Dump(req); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,155 @@
+package har
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// collector is a storage.Dumper that keeps what it's given.
+type collector []*storage.Request
+
+func (c *collector) Dump(req *storage.Request) error {
+	*c = append(*c, req)
+	return nil
+}
+
+// parse parses a stored request's head, and reads its body back.
+func parse(t *testing.T, req *storage.Request) (*http.Request, []byte) {
+	t.Helper()
+	r, err := req.HTTPRequest()
+	if err != nil {
+		t.Fatalf("stored head doesn't parse: %v\n%s", err, req.Head)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, body
+}
+
+func TestRoundTrip(t *testing.T) {
+	when := time.Date(2024, 5, 1, 12, 34, 56, 789000000, time.UTC)
+	reqs := []*storage.Request{
+		{
+			Head: []byte("POST /hook?source=test&id=7 HTTP/1.1\r\nHost: example.com\r\n" +
+				"Content-Type: application/json\r\nX-Multi: one\r\nX-Multi: two\r\n" +
+				"Cookie: a=1; b=2\r\nContent-Length: 13\r\n\r\n"),
+			Data: []byte(`{"ok":"yes"}` + "\n"),
+			When: when,
+		},
+		{
+			Head: []byte("PUT /blob HTTP/1.1\r\nHost: example.com:8080\r\nContent-Type: application/octet-stream\r\n\r\n"),
+			Data: []byte{0x00, 0xff, 0xfe, 0x80, 'a', 0x00},
+			When: when.Add(time.Second),
+		},
+		{
+			Head: []byte("GET /empty HTTP/1.0\r\nHost: example.com\r\n\r\n"),
+			When: when.Add(2 * time.Second),
+		},
+	}
+
+	var buf bytes.Buffer
+	hw := NewWriter(&buf)
+	for _, req := range reqs {
+		if err := hw.Write(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got collector
+	n, err := Import(&buf, &got)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != len(reqs) || len(got) != len(reqs) {
+		t.Fatalf("imported %d requests (%d stored), want %d", n, len(got), len(reqs))
+	}
+	for i, req := range reqs {
+		if !got[i].When.Equal(req.When) {
+			t.Errorf("request %d: when %s, want %s", i, got[i].When, req.When)
+		}
+		want, wantBody := parse(t, req)
+		r, body := parse(t, got[i])
+		if r.Method != want.Method || r.RequestURI != want.RequestURI || r.Proto != want.Proto || r.Host != want.Host {
+			t.Errorf("request %d: %s %s %s (host %s), want %s %s %s (host %s)", i,
+				r.Method, r.RequestURI, r.Proto, r.Host, want.Method, want.RequestURI, want.Proto, want.Host)
+		}
+		for name, values := range want.Header {
+			if name == "Content-Length" {
+				continue
+			}
+			if got := r.Header.Values(name); len(got) != len(values) || (len(got) > 0 && got[0] != values[0]) {
+				t.Errorf("request %d: header %s %q, want %q", i, name, got, values)
+			}
+		}
+		if !bytes.Equal(body, wantBody) {
+			t.Errorf("request %d: body %q, want %q", i, body, wantBody)
+		}
+		if len(wantBody) == 0 && r.Header.Get("Content-Length") != "" {
+			t.Errorf("request %d: empty body with Content-Length %s", i, r.Header.Get("Content-Length"))
+		}
+	}
+	if multi := got[0].Head; !bytes.Contains(multi, []byte("X-Multi: one\r\nX-Multi: two\r\n")) {
+		t.Errorf("repeated header not kept in order:\n%s", multi)
+	}
+}
+
+func TestReadBrowserHAR(t *testing.T) {
+	f, err := os.Open("testdata/browser.har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got collector
+	if _, err = Import(f, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		method, uri, host, body string
+		header                  map[string]string
+	}{
+		{"GET", "/search?q=red+shoes&page=2", "shop.example.com", "",
+			map[string]string{"Cookie": "session=abc123; theme=dark", "Accept-Language": "en-US,en;q=0.9"}},
+		{"POST", "/cart", "shop.example.com", "item=sku-42&qty=2",
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Content-Length": "17"}},
+		{"PUT", "/v1/items/42", "api.example.com:8080", `{"name":"café","qty":3}`,
+			map[string]string{"Content-Type": "application/json", "Transfer-Encoding": ""}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("imported %d requests, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		r, body := parse(t, got[i])
+		if r.Proto != "HTTP/1.1" {
+			t.Errorf("request %d: proto %s, want HTTP/1.1", i, r.Proto)
+		}
+		if r.Method != w.method || r.RequestURI != w.uri || r.Host != w.host {
+			t.Errorf("request %d: %s %s (host %s), want %s %s (host %s)", i, r.Method, r.RequestURI, r.Host, w.method, w.uri, w.host)
+		}
+		for name, value := range w.header {
+			if got := r.Header.Get(name); got != value {
+				t.Errorf("request %d: header %s %q, want %q", i, name, got, value)
+			}
+		}
+		for name := range r.Header {
+			if name[0] == ':' {
+				t.Errorf("request %d: pseudo-header %s kept", i, name)
+			}
+		}
+		if string(body) != w.body {
+			t.Errorf("request %d: body %q, want %q", i, body, w.body)
+		}
+	}
+	if when := time.Date(2024, 5, 1, 12, 35, 1, 2000000, time.UTC); !got[1].When.Equal(when) {
+		t.Errorf("request 1: when %s, want %s", got[1].When, when)
+	}
+}
@@ -0,0 +1,233 @@
+// Package ndjson reads and writes archives of stored requests as newline-delimited JSON,
+// one request per line, optionally gzip-compressed.
+//
+// Each line holds the request's ID, timestamp, head and base64-encoded body, along with
+// metadata parsed from the head for the benefit of tools like jq and grep. The metadata
+// is informational only, and is ignored when the archive is read back.
+package ndjson
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// Version is the archive format version written to each record.
+const Version = 1
+
+// Record is one line of an archive.
+type Record struct {
+	Version int       `json:"v"`
+	ID      int64     `json:"id,omitempty"`
+	Batch   *int      `json:"batch,omitempty"`
+	When    time.Time `json:"when"`
+	Head    string    `json:"head"`
+	Body    []byte    `json:"body"`
+	Meta    *Meta     `json:"meta,omitempty"`
+}
+
+// Meta summarizes a request's head. It's omitted when the head can't be parsed.
+type Meta struct {
+	Method      string `json:"method"`
+	Host        string `json:"host,omitempty"`
+	URI         string `json:"uri"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+}
+
+// NewRecord converts a stored request to an archive record.
+func NewRecord(req *storage.Request) *Record {
+	rec := &Record{
+		Version: Version,
+		Batch:   req.Batch,
+		When:    req.When,
+		Head:    string(req.Head),
+		Body:    req.Data,
+	}
+	if req.ID != nil {
+		rec.ID = *req.ID
+	}
+	if r, err := req.HTTPRequest(); err == nil {
+		rec.Meta = &Meta{
+			Method:      r.Method,
+			Host:        r.Host,
+			URI:         r.RequestURI,
+			ContentType: r.Header.Get("Content-Type"),
+			Size:        len(req.Data),
+		}
+	}
+	return rec
+}
+
+// StorageRequest converts a record back to a request suitable for storage.Dumper.
+// The ID and batch aren't carried over, since they belong to the store the record came from.
+func (rec *Record) StorageRequest() *storage.Request {
+	return &storage.Request{Head: []byte(rec.Head), Data: rec.Body, When: rec.When}
+}
+
+// Writer streams records to an archive. It also implements storage.Processor,
+// so batches can be archived with storage.ProcessBatch.
+type Writer struct {
+	// Sync, if set, is called by ProcessRequests after flushing, so a batch is on disk,
+	// not just handed to the operating system, before it's marked done. Usually (*os.File).Sync.
+	Sync func() error
+
+	bw  *bufio.Writer
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+// NewWriter returns a Writer that writes an archive to w, gzip-compressed if compress is set.
+// Close must be called to flush it.
+func NewWriter(w io.Writer, compress bool) *Writer {
+	aw := &Writer{}
+	if compress {
+		aw.gz = gzip.NewWriter(w)
+		w = aw.gz
+	}
+	aw.bw = bufio.NewWriter(w)
+	aw.enc = json.NewEncoder(aw.bw)
+	return aw
+}
+
+// Write appends one request to the archive.
+func (aw *Writer) Write(req *storage.Request) error {
+	if err := aw.enc.Encode(NewRecord(req)); err != nil {
+		return fmt.Errorf("ndjson.Write: %s", err)
+	}
+	return nil
+}
+
+// ProcessRequests appends each request to the archive, flushes it, and calls Sync if it's set,
+// so a batch isn't marked done before it's been handed to the underlying io.Writer.
+func (aw *Writer) ProcessRequests(reqs []storage.Request) error {
+	for i := range reqs {
+		if err := aw.Write(&reqs[i]); err != nil {
+			return err
+		}
+	}
+	if err := aw.flush(); err != nil {
+		return err
+	}
+	if aw.Sync != nil {
+		if err := aw.Sync(); err != nil {
+			return fmt.Errorf("ndjson.Sync: %s", err)
+		}
+	}
+	return nil
+}
+
+func (aw *Writer) flush() error {
+	if err := aw.bw.Flush(); err != nil {
+		return fmt.Errorf("ndjson.Flush: %s", err)
+	}
+	if aw.gz != nil {
+		if err := aw.gz.Flush(); err != nil {
+			return fmt.Errorf("ndjson.Flush: %s", err)
+		}
+	}
+	return nil
+}
+
+// Close flushes the archive, and finishes the gzip stream if there is one.
+// It doesn't close the underlying io.Writer.
+func (aw *Writer) Close() error {
+	if err := aw.bw.Flush(); err != nil {
+		return fmt.Errorf("ndjson.Close: %s", err)
+	}
+	if aw.gz != nil {
+		if err := aw.gz.Close(); err != nil {
+			return fmt.Errorf("ndjson.Close: %s", err)
+		}
+	}
+	return nil
+}
+
+// Reader streams records from an archive.
+type Reader struct {
+	gz  *gzip.Reader
+	dec *json.Decoder
+}
+
+// NewReader returns a Reader for the archive in r. Compressed archives are detected
+// automatically, from the gzip header.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	ar := &Reader{}
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		if ar.gz, err = gzip.NewReader(br); err != nil {
+			return nil, fmt.Errorf("ndjson.NewReader: %s", err)
+		}
+		ar.dec = json.NewDecoder(ar.gz)
+	} else {
+		ar.dec = json.NewDecoder(br)
+	}
+	return ar, nil
+}
+
+// Read returns the next request in the archive, or io.EOF when there are no more.
+func (ar *Reader) Read() (*storage.Request, error) {
+	rec := &Record{}
+	if err := ar.dec.Decode(rec); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("ndjson.Read: %s", err)
+	}
+	if rec.Version > Version {
+		return nil, fmt.Errorf("ndjson.Read: unsupported version [%d]", rec.Version)
+	}
+	return rec.StorageRequest(), nil
+}
+
+// Close releases the gzip stream, if there is one. It doesn't close the underlying io.Reader.
+func (ar *Reader) Close() error {
+	if ar.gz != nil {
+		return ar.gz.Close()
+	}
+	return nil
+}
+
+// Export archives every pending request in b, one batch at a time, until none are left.
+// Each batch is marked done once it's been written, so this drains b; use a
+// storage.Inspector and Writer.Write to archive requests without consuming them.
+func Export(b storage.Batcher, aw *Writer) (int, error) {
+	total := 0
+	for {
+		n, err := storage.ProcessBatch(b, aw)
+		total += n
+		if err != nil {
+			return total, err
+		} else if n == 0 {
+			return total, aw.Close()
+		}
+	}
+}
+
+// Import stores every request in the archive in r with d, returning how many were stored.
+func Import(r io.Reader, d storage.Dumper) (int, error) {
+	ar, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer ar.Close()
+
+	n := 0
+	for {
+		req, err := ar.Read()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if err = d.Dump(req); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,116 @@
+package ndjson
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// collector is a storage.Dumper that keeps what it's given.
+type collector []*storage.Request
+
+func (c *collector) Dump(req *storage.Request) error {
+	*c = append(*c, req)
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	id, batch := int64(42), 7
+	when := time.Date(2024, 5, 1, 12, 34, 56, 789000000, time.UTC)
+	reqs := []storage.Request{
+		{
+			ID:    &id,
+			Batch: &batch,
+			Head: []byte("POST /hook?source=test HTTP/1.1\r\nHost: example.com\r\n" +
+				"Content-Type: application/json\r\nX-Multi: one\r\nX-Multi: two\r\nContent-Length: 13\r\n\r\n"),
+			Data: []byte(`{"ok":"yes"}` + "\n"),
+			When: when,
+		},
+		{
+			Head: []byte("PUT /blob HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/octet-stream\r\n\r\n"),
+			Data: []byte{0x00, 0xff, 0xfe, 0x80, '\n', 0x00},
+			When: when.Add(time.Second),
+		},
+		{
+			Head: []byte("GET /empty HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+			When: when.In(time.FixedZone("EST", -5*3600)),
+		},
+		{
+			// Heads that don't parse are still archived, without metadata.
+			Head: []byte("not an HTTP request"),
+			When: when,
+		},
+	}
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		synced := 0
+		aw := NewWriter(&buf, compress)
+		aw.Sync = func() error {
+			synced++
+			return nil
+		}
+		if err := aw.ProcessRequests(reqs); err != nil {
+			t.Fatal(err)
+		}
+		if synced != 1 {
+			t.Errorf("compress %v: Sync called %d times, want 1", compress, synced)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if gz := bytes.HasPrefix(buf.Bytes(), []byte{0x1f, 0x8b}); gz != compress {
+			t.Fatalf("compress %v: archive starts with % x", compress, buf.Bytes()[:2])
+		}
+		if !compress && strings.Count(buf.String(), "\n") != len(reqs) {
+			t.Fatalf("archive isn't one line per request:\n%s", buf.String())
+		}
+
+		var got collector
+		n, err := Import(&buf, &got)
+		if err != nil {
+			t.Fatal(err)
+		} else if n != len(reqs) || len(got) != len(reqs) {
+			t.Fatalf("compress %v: imported %d requests (%d stored), want %d", compress, n, len(got), len(reqs))
+		}
+		for i, req := range reqs {
+			if !bytes.Equal(got[i].Head, req.Head) {
+				t.Errorf("compress %v, request %d: head %q, want %q", compress, i, got[i].Head, req.Head)
+			}
+			if !bytes.Equal(got[i].Data, req.Data) {
+				t.Errorf("compress %v, request %d: body %q, want %q", compress, i, got[i].Data, req.Data)
+			}
+			if !got[i].When.Equal(req.When) {
+				t.Errorf("compress %v, request %d: when %s, want %s", compress, i, got[i].When, req.When)
+			}
+			if got[i].ID != nil || got[i].Batch != nil {
+				t.Errorf("compress %v, request %d: ID and batch carried over", compress, i)
+			}
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	rec := NewRecord(&storage.Request{
+		Head: []byte("POST /a?b=c HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\n\r\n"),
+		Data: []byte("hello"),
+	})
+	want := Meta{Method: "POST", Host: "example.com", URI: "/a?b=c", ContentType: "text/plain", Size: 5}
+	if rec.Meta == nil || *rec.Meta != want {
+		t.Fatalf("meta %+v, want %+v", rec.Meta, want)
+	}
+	if rec = NewRecord(&storage.Request{Head: []byte("garbage")}); rec.Meta != nil {
+		t.Fatalf("meta %+v for an unparseable head", rec.Meta)
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	var got collector
+	_, err := Import(strings.NewReader(`{"v":2,"when":"2024-05-01T00:00:00Z","head":"GET / HTTP/1.1\r\n\r\n"}`+"\n"), &got)
+	if err == nil || len(got) != 0 {
+		t.Fatalf("imported %d requests from a newer version, err %v", len(got), err)
+	}
+}
@@ -0,0 +1,117 @@
+// Package forward re-sends stored HTTP requests to another server.
+package forward
+
+import (
+	"fmt"
+	"io"
+	iou "io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// hopHeaders apply to a single connection, and aren't forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwarder implements storage.Processor by sending each request, with its
+// original method, path, query string, headers and body, to Target.
+type Forwarder struct {
+	Target *url.URL
+	Client *http.Client
+}
+
+// NewForwarder returns a Forwarder that sends requests to the server at target,
+// such as "http://127.0.0.1:8080". Any path in target is prepended to forwarded paths.
+func NewForwarder(target string) (*Forwarder, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("forward.NewForwarder: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("forward.NewForwarder: unsupported scheme [%s]", u.Scheme)
+	}
+	return &Forwarder{Target: u, Client: &http.Client{}}, nil
+}
+
+// Outgoing returns a copy of req addressed to the Forwarder's target.
+func (f *Forwarder) Outgoing(req *storage.Request) (*http.Request, error) {
+	in, err := req.HTTPRequest()
+	if err != nil {
+		return nil, fmt.Errorf("forward.Outgoing: %s", err)
+	}
+
+	u := *f.Target
+	u.Path = singleJoiningSlash(f.Target.Path, in.URL.Path)
+	u.RawQuery = in.URL.RawQuery
+
+	out, err := http.NewRequest(in.Method, u.String(), in.Body)
+	if err != nil {
+		return nil, fmt.Errorf("forward.Outgoing: %s", err)
+	}
+	out.ContentLength = in.ContentLength
+	for k, vs := range in.Header {
+		out.Header[k] = vs
+	}
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	return out, nil
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch {
+	case a == "" || a == "/":
+		return b
+	case a[len(a)-1] == '/' && len(b) > 0 && b[0] == '/':
+		return a + b[1:]
+	case a[len(a)-1] != '/' && (len(b) == 0 || b[0] != '/'):
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// Send forwards one request. Server errors (5xx) are returned as errors,
+// since they may succeed later; other responses are logged if they aren't 2xx.
+func (f *Forwarder) Send(req *storage.Request) error {
+	out, err := f.Outgoing(req)
+	if err != nil {
+		// A request that can't be parsed won't parse next time either.
+		log.Printf("%s\n", err)
+		return nil
+	}
+
+	res, err := f.Client.Do(out)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(iou.Discard, res.Body)
+
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("forward.Send: %s %s: %s", out.Method, out.URL, res.Status)
+	} else if res.StatusCode >= 300 {
+		log.Printf("forward.Send: %s %s: %s\n", out.Method, out.URL, res.Status)
+	}
+	return nil
+}
+
+// ProcessRequests forwards each request in order, stopping at the first error.
+func (f *Forwarder) ProcessRequests(reqs []storage.Request) error {
+	for i := range reqs {
+		if err := f.Send(&reqs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	iou "io/ioutil"
@@ -9,9 +10,12 @@ import (
 	"net/http"
 	httpu "net/http/httputil"
 	"os"
+	"os/signal"
 	re "regexp"
+	"syscall"
 	"time"
 
+	"github.com/SparkPost/httpdump/server"
 	"github.com/SparkPost/httpdump/storage"
 	"github.com/SparkPost/httpdump/storage/pg"
 )
@@ -19,6 +23,10 @@ import (
 // Command line option declarations.
 var port = flag.Int("port", 80, "port to listen for requests")
 var batchInterval = flag.Int("batch-interval", 10, "how often to process stored requests")
+var debounce = flag.Int("debounce", 0, "how long to wait after requests arrive before sending them, in milliseconds")
+var notify = flag.Bool("notify", false, "announce stored requests with PostgreSQL NOTIFY, so they're sent right away")
+var leader = flag.Bool("leader", false, "only send batches while elected leader among instances sharing the schema")
+var shutdownTimeout = flag.Int("shutdown-timeout", 30, "how long to wait for in-flight work when stopping")
 
 // Loggly contains all the information needed to submit messages.
 type Loggly struct {
@@ -114,38 +122,50 @@ func main() {
 	flag.Parse()
 
 	// Env vars we'll be checking for, mapped to the regular expressions
-	// we'll use to validate their values.
+	// we'll use to validate their values. The password can be anything,
+	// since it's quoted in the connection string.
 	envVars := map[string]*re.Regexp{
 		"LOGGLY_TOKEN":      uuid,
 		"POSTGRESQL_DB":     word,
 		"POSTGRESQL_USER":   word,
-		"POSTGRESQL_PASS":   pass,
+		"POSTGRESQL_PASS":   nil,
 		"POSTGRESQL_SCHEMA": word,
+		"ADMIN_TOKEN":       pass,
 	}
 	opts := map[string]string{}
 	for k, v := range envVars {
 		opts[k] = os.Getenv(k)
-		if !v.MatchString(opts[k]) {
+		if v != nil && !v.MatchString(opts[k]) {
 			log.Fatalf("Unexpected value for %s, double check your parameters.", k)
 		}
 	}
 
+	// Connection settings not covered above, such as PGHOST, come from the standard libpq variables.
 	pgcfg := &pg.PGConfig{
 		Db:   opts["POSTGRESQL_DB"],
 		User: opts["POSTGRESQL_USER"],
 		Pass: opts["POSTGRESQL_PASS"],
-		Opts: map[string]string{
-			"sslmode": "disable",
-		},
+	}
+	if err := pgcfg.LoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if pgcfg.SSLMode == "" {
+		pgcfg.SSLMode = "disable"
 	}
 	dbh, err := pgcfg.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Configure the PostgreSQL dumper.
-	pgDumper := &pg.PgDumper{Schema: opts["POSTGRESQL_SCHEMA"]}
+	// Configure the PostgreSQL dumper. With -notify, its DSN lets it listen for newly stored requests,
+	// so they're sent to Loggly right away instead of waiting for the next batch interval.
+	pgDumper := &pg.PgDumper{Schema: opts["POSTGRESQL_SCHEMA"], Notify: *notify}
 	pgDumper.Dbh = dbh
+	retry := pg.DefaultRetryPolicy
+	pgDumper.Retry = &retry
+	if pgDumper.DSN, err = pgcfg.DSN(); err != nil {
+		log.Fatal(err)
+	}
 	err = pg.SchemaInit(dbh, pgDumper.Schema)
 	if err != nil {
 		log.Fatal(err)
@@ -160,28 +180,24 @@ func main() {
 	}
 	loggly.buf = bytes.NewBuffer(make([]byte, 0, loggly.BatchMax))
 
-	// Set up our handler which writes to, and reads from PostgreSQL.
-	reqDumper := storage.HandlerFactory(pgDumper)
-
-	// Start up recurring job to process events stored in PostgreSQL.
-	interval := time.Duration(*batchInterval) * time.Second
-	ticker := time.NewTicker(interval)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				go func() {
-					_, err := storage.ProcessBatch(pgDumper, loggly)
-					if err != nil {
-						log.Printf("%s\n", err)
-					}
-				}()
-			}
-		}
-	}()
-
-	// Spin up HTTP listener on the requested port.
-	http.HandleFunc("/", reqDumper)
-	portSpec := fmt.Sprintf(":%d", *port)
-	log.Fatal(http.ListenAndServe(portSpec, nil))
+	// Serve requests, storing them in PostgreSQL and sending them to Loggly in batches,
+	// until we're told to stop.
+	srv := &server.Server{
+		Addr:            fmt.Sprintf(":%d", *port),
+		Store:           pgDumper,
+		Processor:       loggly,
+		BatchInterval:   time.Duration(*batchInterval) * time.Second,
+		Debounce:        time.Duration(*debounce) * time.Millisecond,
+		ShutdownTimeout: time.Duration(*shutdownTimeout) * time.Second,
+		AdminToken:      opts["ADMIN_TOKEN"],
+	}
+	if *leader {
+		srv.Elector = &pg.Leader{Dbh: dbh, Schema: pgDumper.Schema}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err = srv.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,280 @@
+// Package server runs an HTTP listener that stores incoming requests, and
+// processes stored requests in batches, until it's told to shut down.
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/admin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server stores requests received on Addr in Store, and passes them to Processor in batches.
+// Optional features are enabled by what Store implements: storage.Backlogger adds backlog metrics,
+// storage.Pinger adds /readyz, storage.Inspector adds the admin API (if AdminToken is set),
+// storage.Purger is swept (if Retention is set), storage.Notifier triggers batches between ticks,
+// and io.Closer is called on shutdown.
+type Server struct {
+	Addr  string
+	Store storage.DumpBatcher
+	// Dumper, if set, stores incoming requests instead of Store, such as a groupcommit.Dumper
+	// wrapping it. It's closed on shutdown, if it's an io.Closer, before the final batch.
+	Dumper storage.Dumper
+	// Processor may be nil, in which case requests are stored but never processed.
+	Processor     storage.Processor
+	BatchInterval time.Duration
+	// Debounce is how long to wait after a storage.Notifier announces new requests before
+	// processing them, so a burst is sent together. Zero processes them right away.
+	Debounce        time.Duration
+	ShutdownTimeout time.Duration
+	// MaxStall is how long /readyz allows between successful batches. Defaults to three batch intervals.
+	MaxStall   time.Duration
+	AdminToken string
+	// Retention is how long processed requests are kept by a storage.Purger before they're purged.
+	// They're checked for every tenth of Retention, or every hour if that's sooner.
+	Retention time.Duration
+	// Elector, if set, chooses which of several servers sharing Store processes batches.
+	// The others store requests, and take over if the leader goes away.
+	Elector storage.Elector
+	// Mux, if set, is used instead of a new http.ServeMux, so callers can add their own handlers.
+	Mux *http.ServeMux
+}
+
+// Handler returns the mux serving request storage, metrics, health checks and the admin API.
+func (s *Server) Handler() (http.Handler, error) {
+	mux := s.Mux
+	if mux == nil {
+		mux = http.NewServeMux()
+	}
+
+	// Expose metrics, including the size of the backlog if the backend reports it.
+	if b, ok := s.Store.(storage.Backlogger); ok {
+		err := prometheus.Register(storage.NewBacklogCollector(b))
+		if _, dup := err.(prometheus.AlreadyRegisteredError); err != nil && !dup {
+			return nil, err
+		}
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Report liveness, and readiness based on storage and recent batch processing.
+	mux.HandleFunc("/healthz", storage.HealthzHandler)
+	if p, ok := s.Store.(storage.Pinger); ok {
+		maxStall := s.MaxStall
+		if maxStall == 0 && s.Processor != nil {
+			maxStall = 3 * s.BatchInterval
+		}
+		mux.HandleFunc("/readyz", storage.ReadyzFactory(p, maxStall, s.Elector))
+	}
+
+	// Optionally expose the admin API, for looking into and managing the queue.
+	if s.AdminToken != "" {
+		i, ok := s.Store.(storage.Inspector)
+		if !ok {
+			return nil, fmt.Errorf("server: %T doesn't support the admin API", s.Store)
+		}
+		adminHandler, err := admin.Handler(i, s.AdminToken)
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle("/admin/", http.StripPrefix("/admin", adminHandler))
+	}
+
+	dumper := s.Dumper
+	if dumper == nil {
+		dumper = s.Store
+	}
+	mux.HandleFunc("/", storage.HandlerFactory(dumper))
+	return mux, nil
+}
+
+// Run serves requests and processes batches until ctx is done, or listening fails, in which
+// case that error is returned once it has shut down. To shut down, it stops accepting
+// connections, waits for in-flight requests to be stored and running batches to finish,
+// processes one last batch, and closes Store, all within ShutdownTimeout.
+func (s *Server) Run(ctx context.Context) error {
+	handler, err := s.Handler()
+	if err != nil {
+		return err
+	}
+
+	// Campaign for leadership, if batch processing is shared with other servers.
+	// Leadership is kept until after the final batch, so it's given up last.
+	resign := func() {}
+	if s.Elector != nil {
+		ectx, cancelElect := context.WithCancel(context.Background())
+		elected := make(chan struct{})
+		go func() {
+			defer close(elected)
+			s.Elector.Campaign(ectx)
+		}()
+		var once sync.Once
+		resign = func() {
+			once.Do(func() {
+				cancelElect()
+				<-elected
+			})
+		}
+		defer resign()
+	}
+
+	// Process stored requests in one goroutine, so batches never overlap: one batch every
+	// BatchInterval, and as soon as requests are stored, if the backend announces them.
+	// The ticker keeps running alongside notifications, in case one is missed.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	if s.Processor != nil {
+		var wake <-chan struct{}
+		if n, ok := s.Store.(storage.Notifier); ok {
+			nctx, cancelNotify := context.WithCancel(ctx)
+			defer cancelNotify()
+			var err error
+			wake, err = n.Notifications(nctx)
+			if err != nil {
+				log.Printf("Processing every %s without notifications: %s\n", s.BatchInterval, err)
+			}
+		}
+		ticker := time.NewTicker(s.BatchInterval)
+		go func() {
+			defer close(stopped)
+			defer ticker.Stop()
+			s.processBatches(ticker.C, wake, stop)
+		}()
+	} else {
+		close(stopped)
+	}
+
+	// Purge processed requests once they're older than the retention period.
+	if p, ok := s.Store.(storage.Purger); ok && s.Retention > 0 {
+		sweepCtx, cancelSweep := context.WithCancel(ctx)
+		defer cancelSweep()
+		interval := s.Retention / 10
+		if interval > time.Hour {
+			interval = time.Hour
+		}
+		go storage.Sweep(sweepCtx, p, s.Retention, interval)
+	}
+
+	// Spin up HTTP listener on the requested address.
+	srv := &http.Server{Addr: s.Addr, Handler: handler}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- srv.ListenAndServe()
+	}()
+
+	// If the listener fails, shut down the same way, so the stores are still closed.
+	var listenFailed error
+	select {
+	case listenFailed = <-listenErr:
+		log.Printf("Shutting down: %s\n", listenFailed)
+	case <-ctx.Done():
+		log.Printf("Shutting down\n")
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections, and let in-flight requests finish being stored.
+	err = srv.Shutdown(sctx)
+	if err != nil {
+		log.Printf("Shutdown: %s\n", err)
+	}
+
+	// Write out anything still queued for storage.
+	if c, ok := s.Dumper.(io.Closer); ok {
+		if err = c.Close(); err != nil {
+			log.Printf("Shutdown: %s\n", err)
+		}
+	}
+
+	// Stop starting new batches, and wait for the running one.
+	close(stop)
+	select {
+	case <-stopped:
+	case <-sctx.Done():
+		log.Printf("Shutdown: gave up waiting for the running batch: %s\n", sctx.Err())
+	}
+
+	// Process anything stored since the last batch.
+	if s.Processor != nil && s.leading() {
+		n, err := storage.ProcessBatchContext(sctx, s.Store, s.Processor)
+		if err != nil {
+			log.Printf("Shutdown: final batch: %s\n", err)
+		} else {
+			log.Printf("Shutdown: final batch processed %d requests\n", n)
+		}
+	}
+
+	resign()
+	if c, ok := s.Store.(io.Closer); ok {
+		if err = c.Close(); err != nil {
+			if listenFailed != nil {
+				log.Printf("Shutdown: %s\n", err)
+				return listenFailed
+			}
+			return fmt.Errorf("Shutdown: %s", err)
+		}
+	}
+	return listenFailed
+}
+
+// processBatches processes a batch on every tick, and when wake fires, waits Debounce for more
+// requests to arrive, then keeps going while there are batches to process. wake may be nil,
+// or closed if notifications stop. It returns once stop is closed.
+func (s *Server) processBatches(tick <-chan time.Time, wake <-chan struct{}, stop <-chan struct{}) {
+	var debounce <-chan time.Time
+	for {
+		drain := false
+		select {
+		case <-tick:
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+				continue
+			}
+			if s.Debounce > 0 {
+				if debounce == nil {
+					debounce = time.After(s.Debounce)
+				}
+				continue
+			}
+			drain = true
+		case <-debounce:
+			debounce = nil
+			drain = true
+		case <-stop:
+			return
+		}
+
+		for s.leading() {
+			n, err := storage.ProcessBatch(s.Store, s.Processor)
+			if err != nil {
+				log.Printf("%s\n", err)
+				break
+			} else if n == 0 || !drain {
+				break
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// leading reports whether this server should process batches: always, unless an Elector says otherwise.
+func (s *Server) leading() bool {
+	if s.Elector == nil {
+		return true
+	}
+	leading, _ := s.Elector.Leading()
+	return leading
+}
@@ -0,0 +1,312 @@
+// Package admin provides an authenticated HTTP API for inspecting and managing stored requests.
+//
+// Every endpoint requires an "Authorization: Bearer <token>" header. Paths are relative
+// to wherever the handler is mounted, typically with http.StripPrefix:
+//
+//	GET    /requests               list requests, see ParseFilter for parameters, plus offset and limit
+//	DELETE /requests               delete requests matching a (non-empty) filter
+//	GET    /requests/{id}          fetch one request
+//	GET    /batches                list batches that aren't done
+//	GET    /batches/{id}           show one batch
+//	POST   /batches/{id}/requeue   move a batch's requests back to pending
+//
+// Operations the backend doesn't support respond 501 Not Implemented.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// DefaultLimit is how many requests are listed when no limit is given.
+const DefaultLimit = 100
+
+// Request is the JSON representation of a storage.Request.
+// Data is base64-encoded, since request bodies may be binary.
+type Request struct {
+	ID    int64     `json:"id"`
+	Batch int64     `json:"batch,omitempty"`
+	When  time.Time `json:"when"`
+	Head  string    `json:"head"`
+	Data  []byte    `json:"data"`
+	// Done is set for processed requests kept by the backend's retention mode.
+	Done *time.Time `json:"done,omitempty"`
+}
+
+// NewRequest converts a storage.Request to its JSON representation.
+func NewRequest(req *storage.Request) *Request {
+	r := &Request{When: req.When, Head: string(req.Head), Data: req.Data, Done: req.Done}
+	if req.ID != nil {
+		r.ID = *req.ID
+	}
+	if req.Batch != nil {
+		r.Batch = int64(*req.Batch)
+	}
+	return r
+}
+
+type handler struct {
+	i     storage.Inspector
+	token []byte
+}
+
+// Handler returns an http.Handler serving the admin API for i, which only
+// responds to requests authenticated with token. The token must not be empty.
+func Handler(i storage.Inspector, token string) (http.Handler, error) {
+	if token == "" {
+		return nil, fmt.Errorf("admin.Handler: an empty token is not allowed")
+	}
+	return &handler{i: i, token: []byte(token)}, nil
+}
+
+func (h *handler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := []byte(strings.TrimPrefix(auth, "Bearer "))
+	return subtle.ConstantTimeCompare(given, h.token) == 1
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="httpdump"`)
+		httpError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "requests":
+		switch r.Method {
+		case http.MethodGet:
+			h.listRequests(w, r)
+		case http.MethodDelete:
+			h.deleteRequests(w, r)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+
+	case len(parts) == 2 && parts[0] == "requests":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		h.getRequest(w, parts[1])
+
+	case len(parts) == 1 && parts[0] == "batches":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		h.listBatches(w)
+
+	case len(parts) == 2 && parts[0] == "batches":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		h.getBatch(w, parts[1])
+
+	case len(parts) == 3 && parts[0] == "batches" && parts[2] == "requeue":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		h.requeueBatch(w, parts[1])
+
+	default:
+		httpError(w, http.StatusNotFound, fmt.Errorf("no such endpoint [%s]", r.URL.Path))
+	}
+}
+
+// ParseFilter reads a storage.Filter from query parameters:
+// state (pending, batched or done), batch, after and before (RFC 3339), min_id and max_id.
+func ParseFilter(q url.Values) (storage.Filter, error) {
+	f := storage.Filter{}
+	var err error
+
+	switch state := storage.State(q.Get("state")); state {
+	case "", storage.StatePending, storage.StateBatched, storage.StateDone:
+		f.State = state
+	default:
+		return f, fmt.Errorf("unknown state [%s]", state)
+	}
+
+	ints := map[string]*int64{"batch": &f.Batch, "min_id": &f.MinID, "max_id": &f.MaxID}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return f, fmt.Errorf("bad %s [%s]", name, v)
+			}
+		}
+	}
+
+	times := map[string]*time.Time{"after": &f.After, "before": &f.Before}
+	for name, dst := range times {
+		if v := q.Get(name); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("bad %s [%s]", name, v)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func (h *handler) listRequests(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := ParseFilter(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	offset, limit := 0, DefaultLimit
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("bad offset [%s]", v))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("bad limit [%s]", v))
+			return
+		}
+	}
+
+	reqs, err := h.i.ListRequests(f, offset, limit)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	out := make([]*Request, len(reqs))
+	for i := range reqs {
+		out[i] = NewRequest(&reqs[i])
+	}
+	writeJSON(w, map[string]interface{}{
+		"offset":   offset,
+		"limit":    limit,
+		"requests": out,
+	})
+}
+
+func (h *handler) deleteRequests(w http.ResponseWriter, r *http.Request) {
+	f, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if f.IsZero() {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("refusing to delete without a filter"))
+		return
+	}
+
+	n, err := h.i.DeleteRequests(f)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("admin: deleted %d requests matching [%s]\n", n, r.URL.RawQuery)
+	writeJSON(w, map[string]int64{"deleted": n})
+}
+
+func (h *handler) getRequest(w http.ResponseWriter, idStr string) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("bad request id [%s]", idStr))
+		return
+	}
+	req, err := h.i.GetRequest(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, NewRequest(req))
+}
+
+func (h *handler) listBatches(w http.ResponseWriter) {
+	batches, err := h.i.Batches()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"batches": batches})
+}
+
+func (h *handler) getBatch(w http.ResponseWriter, idStr string) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("bad batch id [%s]", idStr))
+		return
+	}
+	batches, err := h.i.Batches()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, b := range batches {
+		if b.ID == id {
+			writeJSON(w, b)
+			return
+		}
+	}
+	httpError(w, http.StatusNotFound, storage.ErrNotFound)
+}
+
+func (h *handler) requeueBatch(w http.ResponseWriter, idStr string) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("bad batch id [%s]", idStr))
+		return
+	}
+	n, err := h.i.RequeueBatch(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("admin: requeued %d requests from batch %d\n", n, id)
+	writeJSON(w, map[string]int64{"requeued": n})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("admin: %s\n", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// storeError reports an error from the Inspector: 404 for storage.ErrNotFound, 501 for
+// storage.ErrNotSupported, and 500 for anything else.
+func storeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		httpError(w, http.StatusNotFound, err)
+	case errors.Is(err, storage.ErrNotSupported):
+		httpError(w, http.StatusNotImplemented, err)
+	default:
+		httpError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
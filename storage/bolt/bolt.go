@@ -0,0 +1,212 @@
+// Package bolt allows storing http request data in an embedded bbolt key-value store,
+// which needs no cgo and no external database server.
+package bolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var (
+	// requestsBucket maps big-endian request IDs to encoded requests.
+	requestsBucket = []byte("requests")
+	// batchesBucket maps big-endian batch IDs to the first request ID in the batch.
+	// A batch ID is the ID of the last request in the batch.
+	batchesBucket = []byte("batches")
+	// metaBucket holds bookkeeping values, such as the highest request ID already batched.
+	metaBucket = []byte("meta")
+	markedKey  = []byte("marked")
+)
+
+type BoltDumper struct {
+	Db *bbolt.DB
+}
+
+func itob(id int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+	return buf
+}
+
+func btoi(buf []byte) int64 {
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+// NewDumper opens (creating if necessary) the database file at path,
+// and returns a BoltDumper that stores request data there.
+func NewDumper(path string) (*BoltDumper, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.NewDumper: %s", err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{requestsBucket, batchesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bolt.NewDumper: %s", err)
+	}
+	return &BoltDumper{Db: db}, nil
+}
+
+// Dump stores a request under the next available ID.
+// Concurrent calls are coalesced into a single transaction by bbolt.
+func (bd *BoltDumper) Dump(req *storage.Request) error {
+	defer storage.TimeBackend("bolt", "dump")()
+	err := bd.Db.Batch(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		id := int64(seq)
+		rec := *req
+		rec.ID = &id
+		buf, err := rec.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(id), buf)
+	})
+	if err != nil {
+		return fmt.Errorf("bolt.Dump: %s", err)
+	}
+	return nil
+}
+
+func (bd *BoltDumper) MarkBatch() (int64, error) {
+	defer storage.TimeBackend("bolt", "mark_batch")()
+	var batchID int64
+	err := bd.Db.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		var marked int64
+		if v := meta.Get(markedKey); v != nil {
+			marked = btoi(v)
+		}
+		last := int64(tx.Bucket(requestsBucket).Sequence())
+		if last <= marked {
+			return nil
+		}
+		if err := tx.Bucket(batchesBucket).Put(itob(last), itob(marked+1)); err != nil {
+			return err
+		}
+		if err := meta.Put(markedKey, itob(last)); err != nil {
+			return err
+		}
+		batchID = last
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("bolt.MarkBatch: %s", err)
+	}
+	return batchID, nil
+}
+
+func (bd *BoltDumper) ReadRequests(batchID int64) ([]storage.Request, error) {
+	defer storage.TimeBackend("bolt", "read_requests")()
+	reqs := make([]storage.Request, 0, 32)
+	err := bd.Db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(batchesBucket).Get(itob(batchID))
+		if v == nil {
+			return nil
+		}
+		end := itob(batchID)
+		c := tx.Bucket(requestsBucket).Cursor()
+		for k, v := c.Seek(v); k != nil && string(k) <= string(end); k, v = c.Next() {
+			req := storage.Request{}
+			if err := req.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			batch := int(batchID)
+			req.Batch = &batch
+			reqs = append(reqs, req)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.ReadRequests: %s", err)
+	}
+
+	// Match the other backends, which return requests in the order they arrived.
+	sort.SliceStable(reqs, func(i, j int) bool {
+		return reqs[i].When.Before(reqs[j].When)
+	})
+	return reqs, nil
+}
+
+func (bd *BoltDumper) BatchDone(batchID int64) error {
+	defer storage.TimeBackend("bolt", "batch_done")()
+	err := bd.Db.Update(func(tx *bbolt.Tx) error {
+		batches := tx.Bucket(batchesBucket)
+		v := batches.Get(itob(batchID))
+		if v == nil {
+			return nil
+		}
+		end := itob(batchID)
+		requests := tx.Bucket(requestsBucket)
+		for id := btoi(v); id <= batchID; id++ {
+			if err := requests.Delete(itob(id)); err != nil {
+				return err
+			}
+		}
+		return batches.Delete(end)
+	})
+	if err != nil {
+		return fmt.Errorf("bolt.BatchDone: %s", err)
+	}
+	return nil
+}
+
+// Backlog reports how many requests haven't been processed yet, and when the oldest one arrived.
+func (bd *BoltDumper) Backlog() (int64, time.Time, error) {
+	defer storage.TimeBackend("bolt", "backlog")()
+	var pending int64
+	var oldest time.Time
+	err := bd.Db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		pending = int64(b.Stats().KeyN)
+		_, v := b.Cursor().First()
+		if v == nil {
+			return nil
+		}
+		req := storage.Request{}
+		if err := req.UnmarshalBinary(v); err != nil {
+			return err
+		}
+		oldest = req.When
+		return nil
+	})
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("bolt.Backlog: %s", err)
+	}
+	return pending, oldest, nil
+}
+
+// Ping checks that the database is open and readable.
+func (bd *BoltDumper) Ping() error {
+	err := bd.Db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(requestsBucket) == nil {
+			return fmt.Errorf("missing bucket [%s]", requestsBucket)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("bolt.Ping: %s", err)
+	}
+	return nil
+}
+
+// Close releases the database file.
+func (bd *BoltDumper) Close() error {
+	return bd.Db.Close()
+}
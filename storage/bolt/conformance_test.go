@@ -0,0 +1,19 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.DumpBatcher {
+		d, err := NewDumper(filepath.Join(t.TempDir(), "httpdump.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
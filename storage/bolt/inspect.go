@@ -0,0 +1,154 @@
+package bolt
+
+import (
+	"fmt"
+
+	"github.com/SparkPost/httpdump/storage"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// batchOf returns the batch containing request id, or 0 if it's still pending.
+func batchOf(tx *bbolt.Tx, id int64) int64 {
+	// Batches are keyed by their last request ID, so the first batch ending
+	// at or after id is the only one that could contain it.
+	k, v := tx.Bucket(batchesBucket).Cursor().Seek(itob(id))
+	if k == nil || btoi(v) > id {
+		return 0
+	}
+	return btoi(k)
+}
+
+// decode unmarshals a stored request, filling in its batch.
+func decode(tx *bbolt.Tx, v []byte) (*storage.Request, error) {
+	req := &storage.Request{}
+	if err := req.UnmarshalBinary(v); err != nil {
+		return nil, err
+	}
+	if batchID := batchOf(tx, *req.ID); batchID != 0 {
+		batch := int(batchID)
+		req.Batch = &batch
+	}
+	return req, nil
+}
+
+// each calls fn with every stored request matching f, in ID order, until fn returns false.
+func each(tx *bbolt.Tx, f storage.Filter, fn func(*storage.Request) bool) error {
+	c := tx.Bucket(requestsBucket).Cursor()
+	var k, v []byte
+	if f.MinID > 0 {
+		k, v = c.Seek(itob(f.MinID))
+	} else {
+		k, v = c.First()
+	}
+	for ; k != nil; k, v = c.Next() {
+		if f.MaxID != 0 && btoi(k) > f.MaxID {
+			break
+		}
+		req, err := decode(tx, v)
+		if err != nil {
+			return err
+		}
+		if f.Match(req) && !fn(req) {
+			break
+		}
+	}
+	return nil
+}
+
+func (bd *BoltDumper) ListRequests(f storage.Filter, offset, limit int) ([]storage.Request, error) {
+	reqs := make([]storage.Request, 0, 32)
+	err := bd.Db.View(func(tx *bbolt.Tx) error {
+		return each(tx, f, func(req *storage.Request) bool {
+			if offset > 0 {
+				offset--
+				return true
+			}
+			reqs = append(reqs, *req)
+			return limit <= 0 || len(reqs) < limit
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.ListRequests: %s", err)
+	}
+	return reqs, nil
+}
+
+func (bd *BoltDumper) GetRequest(id int64) (*storage.Request, error) {
+	var req *storage.Request
+	err := bd.Db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(requestsBucket).Get(itob(id))
+		if v == nil {
+			return nil
+		}
+		var err error
+		req, err = decode(tx, v)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.GetRequest: %s", err)
+	}
+	if req == nil {
+		return nil, storage.ErrNotFound
+	}
+	return req, nil
+}
+
+func (bd *BoltDumper) Batches() ([]storage.BatchStatus, error) {
+	batches := make([]storage.BatchStatus, 0, 4)
+	err := bd.Db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(batchesBucket).ForEach(func(k, v []byte) error {
+			b := storage.BatchStatus{ID: btoi(k)}
+			c := tx.Bucket(requestsBucket).Cursor()
+			for rk, rv := c.Seek(v); rk != nil && btoi(rk) <= b.ID; rk, rv = c.Next() {
+				req := storage.Request{}
+				if err := req.UnmarshalBinary(rv); err != nil {
+					return err
+				}
+				if b.Requests == 0 || req.When.Before(b.Oldest) {
+					b.Oldest = req.When
+				}
+				if req.When.After(b.Newest) {
+					b.Newest = req.When
+				}
+				b.Requests++
+			}
+			batches = append(batches, b)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.Batches: %s", err)
+	}
+	return batches, nil
+}
+
+// RequeueBatch isn't supported, since batches are contiguous ranges of request IDs.
+func (bd *BoltDumper) RequeueBatch(batchID int64) (int64, error) {
+	return 0, storage.ErrNotSupported
+}
+
+func (bd *BoltDumper) DeleteRequests(f storage.Filter) (int64, error) {
+	var n int64
+	err := bd.Db.Update(func(tx *bbolt.Tx) error {
+		ids := make([]int64, 0, 32)
+		err := each(tx, f, func(req *storage.Request) bool {
+			ids = append(ids, *req.ID)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(requestsBucket)
+		for _, id := range ids {
+			if err := b.Delete(itob(id)); err != nil {
+				return err
+			}
+		}
+		n = int64(len(ids))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("bolt.DeleteRequests: %s", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// requestEncodingVersion is written as the first byte of every encoded Request.
+const requestEncodingVersion = 1
+
+// MarshalBinary encodes the ID, timestamp, headers and body of a Request,
+// for backends that store requests as opaque byte strings.
+// The Batch field is not encoded, since batches are tracked by each backend.
+func (req *Request) MarshalBinary() ([]byte, error) {
+	when, err := req.When.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	if req.ID != nil {
+		id = *req.ID
+	}
+
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64*3+len(when)+len(req.Head)+len(req.Data))
+	buf = append(buf, requestEncodingVersion)
+	buf = binary.AppendVarint(buf, id)
+	buf = binary.AppendUvarint(buf, uint64(len(when)))
+	buf = append(buf, when...)
+	buf = binary.AppendUvarint(buf, uint64(len(req.Head)))
+	buf = append(buf, req.Head...)
+	buf = append(buf, req.Data...)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a Request previously encoded with MarshalBinary.
+func (req *Request) UnmarshalBinary(buf []byte) error {
+	if len(buf) == 0 || buf[0] != requestEncodingVersion {
+		return fmt.Errorf("storage.UnmarshalBinary: unsupported encoding")
+	}
+	buf = buf[1:]
+
+	id, n := binary.Varint(buf)
+	if n <= 0 {
+		return fmt.Errorf("storage.UnmarshalBinary: bad id")
+	}
+	buf = buf[n:]
+
+	whenLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < whenLen {
+		return fmt.Errorf("storage.UnmarshalBinary: bad timestamp")
+	}
+	buf = buf[n:]
+	var when time.Time
+	if err := when.UnmarshalBinary(buf[:whenLen]); err != nil {
+		return fmt.Errorf("storage.UnmarshalBinary: %s", err)
+	}
+	buf = buf[whenLen:]
+
+	headLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < headLen {
+		return fmt.Errorf("storage.UnmarshalBinary: bad head")
+	}
+	buf = buf[n:]
+
+	if id != 0 {
+		req.ID = &id
+	} else {
+		req.ID = nil
+	}
+	req.When = when
+	req.Head = append([]byte(nil), buf[:headLen]...)
+	req.Data = append([]byte(nil), buf[headLen:]...)
+	req.Batch = nil
+	return nil
+}
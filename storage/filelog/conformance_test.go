@@ -0,0 +1,20 @@
+package filelog
+
+import (
+	"testing"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.DumpBatcher {
+		d, err := NewDumper(t.TempDir(), "batch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Small segments, so batches span several of them.
+		d.SegmentSize = 4096
+		return d
+	})
+}
@@ -0,0 +1,594 @@
+// Package filelog allows storing http request data in append-only, segmented log files.
+package filelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// SyncPolicy controls how often appended requests are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every Dump.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs on Dump when SyncInterval has passed since the last fsync.
+	SyncInterval
+	// SyncBatch fsyncs only when a batch is marked.
+	SyncBatch
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// Map shortcut strings to sync policies.
+var SyncPolicies = map[string]SyncPolicy{
+	"always":   SyncAlways,
+	"interval": SyncInterval,
+	"batch":    SyncBatch,
+	"never":    SyncNever,
+}
+
+const (
+	// DefaultSegmentSize is the size, in bytes, after which a new segment file is started.
+	DefaultSegmentSize = 64 * 1024 * 1024
+	// DefaultSyncInterval is how often SyncInterval flushes to disk.
+	DefaultSyncInterval = time.Second
+
+	segmentExt = ".seg"
+	offsetFile = "offsets"
+	headerLen  = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segment is one log file, holding requests with IDs starting at firstID.
+type segment struct {
+	firstID int64
+	path    string
+}
+
+// FileLogDumper appends requests to segment files in a directory, and tracks
+// batches in a separate offsets file. Each record is framed with its length
+// and a checksum, so a torn write at the end of a segment is discarded on open.
+type FileLogDumper struct {
+	// SegmentSize and SyncInterval may be changed before the first call to Dump.
+	SegmentSize  int64
+	SyncInterval time.Duration
+
+	dir      string
+	policy   SyncPolicy
+	lock     *sync.Mutex
+	segments []segment
+	active   *os.File
+	size     int64
+	nextID   int64
+	marked   int64
+	batches  map[int64]int64
+	lastSync time.Time
+	dirty    bool
+}
+
+// NewDumper returns an initialized FileLogDumper that writes segment files to dir,
+// creating it if necessary, and picks up any requests and batches left over from a previous run.
+func NewDumper(dir, syncPolicy string) (*FileLogDumper, error) {
+	policy, ok := SyncPolicies[syncPolicy]
+	if !ok {
+		return nil, fmt.Errorf("`sync` must be one of (`always`, `interval`, `batch`, `never`), not [%s]", syncPolicy)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("filelog.NewDumper: %s", err)
+	}
+
+	fl := &FileLogDumper{
+		SegmentSize:  DefaultSegmentSize,
+		SyncInterval: DefaultSyncInterval,
+		dir:          dir,
+		policy:       policy,
+		lock:         &sync.Mutex{},
+		nextID:       1,
+		batches:      map[int64]int64{},
+		lastSync:     time.Now(),
+	}
+	if err := fl.readOffsets(); err != nil {
+		return nil, err
+	}
+	if err := fl.openSegments(); err != nil {
+		return nil, err
+	}
+	return fl, nil
+}
+
+// readOffsets loads the batch bookkeeping written by writeOffsets.
+func (fl *FileLogDumper) readOffsets() error {
+	file, err := os.Open(filepath.Join(fl.dir, offsetFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("filelog.readOffsets: %s", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("filelog.readOffsets: malformed line [%s]", scanner.Text())
+		}
+		a, errA := strconv.ParseInt(fields[1], 10, 64)
+		b, errB := strconv.ParseInt(fields[2], 10, 64)
+		if errA != nil || errB != nil {
+			return fmt.Errorf("filelog.readOffsets: malformed line [%s]", scanner.Text())
+		}
+		switch fields[0] {
+		case "marked":
+			fl.marked = a
+			if b > fl.nextID {
+				fl.nextID = b
+			}
+		case "batch":
+			fl.batches[b] = a
+		default:
+			return fmt.Errorf("filelog.readOffsets: malformed line [%s]", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("filelog.readOffsets: %s", err)
+	}
+	return nil
+}
+
+// writeOffsets atomically replaces the offsets file with the current batch state.
+// The caller must hold fl.lock.
+func (fl *FileLogDumper) writeOffsets() error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "marked %d %d\n", fl.marked, fl.nextID)
+	for end, start := range fl.batches {
+		fmt.Fprintf(&sb, "batch %d %d\n", start, end)
+	}
+
+	tmpPath := filepath.Join(fl.dir, offsetFile+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("filelog.writeOffsets: %s", err)
+	}
+	if _, err = file.WriteString(sb.String()); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("filelog.writeOffsets: %s", err)
+	}
+	if err = os.Rename(tmpPath, filepath.Join(fl.dir, offsetFile)); err != nil {
+		return fmt.Errorf("filelog.writeOffsets: %s", err)
+	}
+	return fl.syncDir()
+}
+
+// syncDir makes renames and removals within the log directory durable.
+func (fl *FileLogDumper) syncDir() error {
+	if fl.policy == SyncNever {
+		return nil
+	}
+	dir, err := os.Open(fl.dir)
+	if err != nil {
+		return fmt.Errorf("filelog.syncDir: %s", err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("filelog.syncDir: %s", err)
+	}
+	return nil
+}
+
+// openSegments finds existing segment files, recovers the next request ID
+// from the newest one, and opens it for appending.
+func (fl *FileLogDumper) openSegments() error {
+	paths, err := filepath.Glob(filepath.Join(fl.dir, "*"+segmentExt))
+	if err != nil {
+		return fmt.Errorf("filelog.openSegments: %s", err)
+	}
+	for _, path := range paths {
+		firstID, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			log.Printf("filelog.openSegments: skipping unexpected file [%s]\n", path)
+			continue
+		}
+		fl.segments = append(fl.segments, segment{firstID: firstID, path: path})
+	}
+	sort.Slice(fl.segments, func(i, j int) bool {
+		return fl.segments[i].firstID < fl.segments[j].firstID
+	})
+
+	if len(fl.segments) == 0 {
+		return fl.startSegment()
+	}
+
+	last := fl.segments[len(fl.segments)-1]
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("filelog.openSegments: %s", err)
+	}
+
+	// Find the end of the last complete record, discarding anything after it.
+	var lastID int64
+	valid, err := scanRecords(file, func(req *storage.Request) error {
+		lastID = *req.ID
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("filelog.openSegments: %s", err)
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > valid {
+		log.Printf("filelog.openSegments: truncating torn write in [%s] at offset %d\n", last.path, valid)
+		if err = file.Truncate(valid); err != nil {
+			file.Close()
+			return fmt.Errorf("filelog.openSegments: %s", err)
+		}
+	}
+	if _, err = file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("filelog.openSegments: %s", err)
+	}
+
+	if lastID >= fl.nextID {
+		fl.nextID = lastID + 1
+	}
+	if last.firstID > fl.nextID {
+		fl.nextID = last.firstID
+	}
+	fl.active = file
+	fl.size = valid
+	return nil
+}
+
+// startSegment creates a new, empty segment whose first request will be fl.nextID.
+// The caller must hold fl.lock, or be the constructor.
+func (fl *FileLogDumper) startSegment() error {
+	path := filepath.Join(fl.dir, fmt.Sprintf("%020d%s", fl.nextID, segmentExt))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("filelog.startSegment: %s", err)
+	}
+	fl.segments = append(fl.segments, segment{firstID: fl.nextID, path: path})
+	fl.active = file
+	fl.size = 0
+	return fl.syncDir()
+}
+
+// rotate finishes the active segment and starts a new one. If the new segment can't be
+// started, the active one is kept, so requests can still be written to it.
+// The caller must hold fl.lock.
+func (fl *FileLogDumper) rotate() error {
+	if fl.policy != SyncNever {
+		if err := fl.active.Sync(); err != nil {
+			return fmt.Errorf("filelog.rotate: %s", err)
+		}
+	}
+	fl.dirty = false
+	prev := fl.active
+	if err := fl.startSegment(); err != nil {
+		return err
+	}
+	if err := prev.Close(); err != nil {
+		return fmt.Errorf("filelog.rotate: %s", err)
+	}
+	return nil
+}
+
+// discardTorn removes what a failed write left after the last complete record, so the next
+// record doesn't follow a torn one. If the segment can't be truncated, a new one is started.
+// The caller must hold fl.lock.
+func (fl *FileLogDumper) discardTorn() {
+	err := fl.active.Truncate(fl.size)
+	if err == nil {
+		_, err = fl.active.Seek(fl.size, io.SeekStart)
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("filelog.Dump: can't truncate torn write: %s\n", err)
+	// A new segment would have the same name as an empty one.
+	if fl.size == 0 {
+		return
+	}
+	prev := fl.active
+	if err = fl.startSegment(); err != nil {
+		log.Printf("filelog.Dump: %s\n", err)
+		return
+	}
+	prev.Close()
+}
+
+// sync flushes the active segment to disk, if anything was written since the last flush.
+// The caller must hold fl.lock.
+func (fl *FileLogDumper) sync() error {
+	if !fl.dirty {
+		return nil
+	}
+	if err := fl.active.Sync(); err != nil {
+		return fmt.Errorf("filelog.sync: %s", err)
+	}
+	fl.dirty = false
+	fl.lastSync = time.Now()
+	return nil
+}
+
+// scanRecords calls fn for each complete, intact record in r, and returns
+// the offset just past the last one.
+func scanRecords(r io.Reader, fn func(*storage.Request) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	header := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			// EOF, or a partial header from a torn write.
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return offset, nil
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return offset, nil
+		}
+		req := &storage.Request{}
+		if err := req.UnmarshalBinary(payload); err != nil {
+			return offset, nil
+		}
+		if req.ID == nil {
+			return offset, fmt.Errorf("record at offset %d has no id", offset)
+		}
+		if err := fn(req); err != nil {
+			return offset, err
+		}
+		offset += int64(headerLen) + int64(length)
+	}
+}
+
+func (fl *FileLogDumper) Dump(req *storage.Request) error {
+	defer storage.TimeBackend("filelog", "dump")()
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+
+	id := fl.nextID
+	rec := *req
+	rec.ID = &id
+	payload, err := rec.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("filelog.Dump: %s", err)
+	}
+
+	buf := make([]byte, headerLen, headerLen+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	buf = append(buf, payload...)
+
+	n, err := fl.active.Write(buf)
+	if err != nil {
+		if n > 0 {
+			fl.discardTorn()
+		}
+		return fmt.Errorf("filelog.Dump (write): %s", err)
+	}
+	fl.size += int64(n)
+	fl.nextID++
+	fl.dirty = true
+
+	switch fl.policy {
+	case SyncAlways:
+		err = fl.sync()
+	case SyncInterval:
+		if time.Since(fl.lastSync) >= fl.SyncInterval {
+			err = fl.sync()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// The request is stored, so a failed rotation is only logged, and tried again after the next write.
+	if fl.size >= fl.SegmentSize {
+		if err = fl.rotate(); err != nil {
+			log.Printf("filelog.Dump: %s\n", err)
+		}
+	}
+	return nil
+}
+
+func (fl *FileLogDumper) MarkBatch() (int64, error) {
+	defer storage.TimeBackend("filelog", "mark_batch")()
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+
+	end := fl.nextID - 1
+	if end <= fl.marked {
+		return 0, nil
+	}
+	// Requests must be on disk before the batch referring to them is.
+	if fl.policy != SyncNever {
+		if err := fl.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	fl.batches[end] = fl.marked + 1
+	fl.marked = end
+	if err := fl.writeOffsets(); err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+func (fl *FileLogDumper) ReadRequests(batchID int64) ([]storage.Request, error) {
+	defer storage.TimeBackend("filelog", "read_requests")()
+	fl.lock.Lock()
+	start, ok := fl.batches[batchID]
+	segments := make([]segment, len(fl.segments))
+	copy(segments, fl.segments)
+	fl.lock.Unlock()
+
+	reqs := make([]storage.Request, 0, 32)
+	if !ok {
+		return reqs, nil
+	}
+
+	for i, seg := range segments {
+		if seg.firstID > batchID {
+			break
+		}
+		if i+1 < len(segments) && segments[i+1].firstID <= start {
+			continue
+		}
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return nil, fmt.Errorf("filelog.ReadRequests: %s", err)
+		}
+		_, err = scanRecords(file, func(req *storage.Request) error {
+			if *req.ID >= start && *req.ID <= batchID {
+				batch := int(batchID)
+				req.Batch = &batch
+				reqs = append(reqs, *req)
+			}
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("filelog.ReadRequests: %s", err)
+		}
+	}
+
+	// Match the other backends, which return requests in the order they arrived.
+	sort.SliceStable(reqs, func(i, j int) bool {
+		return reqs[i].When.Before(reqs[j].When)
+	})
+	return reqs, nil
+}
+
+func (fl *FileLogDumper) BatchDone(batchID int64) error {
+	defer storage.TimeBackend("filelog", "batch_done")()
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+
+	if _, ok := fl.batches[batchID]; !ok {
+		return nil
+	}
+	delete(fl.batches, batchID)
+	if err := fl.writeOffsets(); err != nil {
+		return err
+	}
+
+	// Everything before the oldest outstanding batch has been processed.
+	done := fl.marked
+	for _, start := range fl.batches {
+		if start-1 < done {
+			done = start - 1
+		}
+	}
+
+	// Remove segments whose requests have all been processed, never the active one.
+	for len(fl.segments) > 1 && fl.segments[1].firstID-1 <= done {
+		if err := os.Remove(fl.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("filelog.BatchDone (remove): %s", err)
+		}
+		fl.segments = fl.segments[1:]
+	}
+	return fl.syncDir()
+}
+
+// Backlog reports how many requests haven't been processed yet, and when the oldest one arrived.
+func (fl *FileLogDumper) Backlog() (int64, time.Time, error) {
+	defer storage.TimeBackend("filelog", "backlog")()
+	fl.lock.Lock()
+	first := fl.marked + 1
+	for _, start := range fl.batches {
+		if start < first {
+			first = start
+		}
+	}
+	pending := fl.nextID - first
+	segments := make([]segment, len(fl.segments))
+	copy(segments, fl.segments)
+	fl.lock.Unlock()
+
+	if pending <= 0 {
+		return 0, time.Time{}, nil
+	}
+
+	// Find the timestamp of the first unprocessed request.
+	var oldest time.Time
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].firstID <= first {
+			continue
+		}
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("filelog.Backlog: %s", err)
+		}
+		_, err = scanRecords(file, func(req *storage.Request) error {
+			if *req.ID >= first {
+				oldest = req.When
+				return io.EOF
+			}
+			return nil
+		})
+		file.Close()
+		if err != nil && err != io.EOF {
+			return 0, time.Time{}, fmt.Errorf("filelog.Backlog: %s", err)
+		}
+		if !oldest.IsZero() {
+			break
+		}
+	}
+	return pending, oldest, nil
+}
+
+// Ping checks that the log directory is still present and the active segment is open.
+func (fl *FileLogDumper) Ping() error {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	if fl.active == nil {
+		return fmt.Errorf("filelog.Ping: log is closed")
+	}
+	if _, err := fl.active.Stat(); err != nil {
+		return fmt.Errorf("filelog.Ping: %s", err)
+	}
+	if _, err := os.Stat(fl.dir); err != nil {
+		return fmt.Errorf("filelog.Ping: %s", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the active segment.
+func (fl *FileLogDumper) Close() error {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+
+	if fl.active == nil {
+		return nil
+	}
+	err := fl.sync()
+	if cerr := fl.active.Close(); err == nil {
+		err = cerr
+	}
+	fl.active = nil
+	return err
+}
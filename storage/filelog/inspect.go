@@ -0,0 +1,147 @@
+package filelog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// errStop ends a scan early without reporting an error.
+var errStop = errors.New("stop")
+
+// each calls fn with every unprocessed request matching f, in ID order,
+// until fn returns false.
+func (fl *FileLogDumper) each(f storage.Filter, fn func(*storage.Request) bool) error {
+	fl.lock.Lock()
+	marked := fl.marked
+	batches := make(map[int64]int64, len(fl.batches))
+	for end, start := range fl.batches {
+		batches[end] = start
+	}
+	segments := make([]segment, len(fl.segments))
+	copy(segments, fl.segments)
+	fl.lock.Unlock()
+
+	// batchOf returns the batch containing id, 0 if it's pending, or -1 if it's been processed.
+	batchOf := func(id int64) int64 {
+		if id > marked {
+			return 0
+		}
+		for end, start := range batches {
+			if id >= start && id <= end {
+				return end
+			}
+		}
+		return -1
+	}
+
+	for i, seg := range segments {
+		if f.MaxID != 0 && seg.firstID > f.MaxID {
+			break
+		}
+		if f.MinID != 0 && i+1 < len(segments) && segments[i+1].firstID <= f.MinID {
+			continue
+		}
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return err
+		}
+		_, err = scanRecords(file, func(req *storage.Request) error {
+			batchID := batchOf(*req.ID)
+			if batchID < 0 {
+				return nil
+			}
+			if batchID > 0 {
+				batch := int(batchID)
+				req.Batch = &batch
+			}
+			if f.Match(req) && !fn(req) {
+				return errStop
+			}
+			return nil
+		})
+		file.Close()
+		if err == errStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fl *FileLogDumper) ListRequests(f storage.Filter, offset, limit int) ([]storage.Request, error) {
+	reqs := make([]storage.Request, 0, 32)
+	err := fl.each(f, func(req *storage.Request) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		reqs = append(reqs, *req)
+		return limit <= 0 || len(reqs) < limit
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filelog.ListRequests: %s", err)
+	}
+	return reqs, nil
+}
+
+func (fl *FileLogDumper) GetRequest(id int64) (*storage.Request, error) {
+	var found *storage.Request
+	err := fl.each(storage.Filter{MinID: id, MaxID: id}, func(req *storage.Request) bool {
+		found = req
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filelog.GetRequest: %s", err)
+	}
+	if found == nil {
+		return nil, storage.ErrNotFound
+	}
+	return found, nil
+}
+
+func (fl *FileLogDumper) Batches() ([]storage.BatchStatus, error) {
+	statuses := map[int64]*storage.BatchStatus{}
+	err := fl.each(storage.Filter{State: storage.StateBatched}, func(req *storage.Request) bool {
+		id := int64(*req.Batch)
+		b, ok := statuses[id]
+		if !ok {
+			b = &storage.BatchStatus{ID: id, Oldest: req.When, Newest: req.When}
+			statuses[id] = b
+		}
+		if req.When.Before(b.Oldest) {
+			b.Oldest = req.When
+		}
+		if req.When.After(b.Newest) {
+			b.Newest = req.When
+		}
+		b.Requests++
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filelog.Batches: %s", err)
+	}
+
+	batches := make([]storage.BatchStatus, 0, len(statuses))
+	for _, b := range statuses {
+		batches = append(batches, *b)
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].ID < batches[j].ID
+	})
+	return batches, nil
+}
+
+// RequeueBatch isn't supported, since batches are contiguous ranges of the log.
+func (fl *FileLogDumper) RequeueBatch(batchID int64) (int64, error) {
+	return 0, storage.ErrNotSupported
+}
+
+// DeleteRequests isn't supported, since the log is append-only.
+func (fl *FileLogDumper) DeleteRequests(f storage.Filter) (int64, error) {
+	return 0, storage.ErrNotSupported
+}
@@ -0,0 +1,134 @@
+package filelog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+func request(i int) *storage.Request {
+	return &storage.Request{
+		Head: []byte(fmt.Sprintf("GET /%d HTTP/1.1\r\nHost: example.com\r\n\r\n", i)),
+		Data: []byte(fmt.Sprintf("body %d", i)),
+		When: time.Unix(int64(1700000000+i), 0),
+	}
+}
+
+// frame returns a record as Dump writes it, for the request with the given ID.
+func frame(t *testing.T, id int64) []byte {
+	t.Helper()
+	req := request(int(id))
+	req.ID = &id
+	payload, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, headerLen, headerLen+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	return append(buf, payload...)
+}
+
+// readAll marks a batch of everything pending, and returns its requests' IDs in order.
+func readAll(t *testing.T, d *FileLogDumper) []int64 {
+	t.Helper()
+	batchID, err := d.MarkBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := d.ReadRequests(batchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, len(reqs))
+	for i, req := range reqs {
+		ids[i] = *req.ID
+		if want := request(int(*req.ID)); string(req.Head) != string(want.Head) || string(req.Data) != string(want.Data) {
+			t.Errorf("request %d: %q %q, want %q %q", *req.ID, req.Head, req.Data, want.Head, want.Data)
+		}
+	}
+	return ids
+}
+
+func TestTornWrite(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		tail func(t *testing.T) []byte
+	}{
+		{"partial header", func(t *testing.T) []byte {
+			return frame(t, 4)[:5]
+		}},
+		{"partial payload", func(t *testing.T) []byte {
+			f := frame(t, 4)
+			return f[:len(f)-3]
+		}},
+		{"bad checksum", func(t *testing.T) []byte {
+			f := frame(t, 4)
+			f[len(f)-1] ^= 0xff
+			return f
+		}},
+		{"garbage", func(t *testing.T) []byte {
+			return []byte{0, 0, 0, 4, 0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4}
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			d, err := NewDumper(dir, "always")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 3; i++ {
+				if err = d.Dump(request(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			segs, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+			if err != nil || len(segs) != 1 {
+				t.Fatalf("segments %v (%v), want 1", segs, err)
+			}
+			info, err := os.Stat(segs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			whole := info.Size()
+			file, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = file.Write(c.tail(t)); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			d, err = NewDumper(dir, "always")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			if info, err = os.Stat(segs[0]); err != nil || info.Size() != whole {
+				t.Fatalf("segment is %d bytes after reopening (%v), want %d", info.Size(), err, whole)
+			}
+
+			// New requests follow the whole ones, and don't end up behind the torn one.
+			for i := 4; i <= 5; i++ {
+				if err = d.Dump(request(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ids := readAll(t, d)
+			if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+				t.Fatalf("read requests %v, want [1 2 3 4 5]", ids)
+			}
+		})
+	}
+}
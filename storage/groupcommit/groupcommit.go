@@ -0,0 +1,177 @@
+// Package groupcommit provides a storage.Dumper that writes requests in groups,
+// so a busy server runs one transaction for many requests instead of one each.
+package groupcommit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// ErrClosed is returned by Dump after Close has been called.
+var ErrClosed = errors.New("groupcommit: dumper is closed")
+
+// pending is a request waiting to be written, the context of whoever is waiting for it,
+// and where to report how it went.
+type pending struct {
+	ctx  context.Context
+	req  *storage.Request
+	done chan error
+}
+
+// Dumper queues requests, and writes them to Target in groups of up to MaxSize requests,
+// waiting at most MaxDelay after the first request in a group arrives. Dump only returns
+// once the request's group has been written, so callers are told whether their request was stored.
+type Dumper struct {
+	Target   storage.Dumper
+	MaxSize  int
+	MaxDelay time.Duration
+
+	queue  chan pending
+	lock   sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewDumper returns a running Dumper that writes to target, queueing up to queueSize requests
+// before Dump blocks. Groups are written with target's DumpMany if it implements storage.ManyDumper,
+// or one request at a time otherwise. If a group fails, its requests are retried one at a time,
+// so one bad request doesn't fail the others.
+func NewDumper(target storage.Dumper, maxSize int, maxDelay time.Duration, queueSize int) (*Dumper, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("groupcommit.NewDumper: maxSize must be positive, not [%d]", maxSize)
+	} else if maxDelay <= 0 {
+		return nil, fmt.Errorf("groupcommit.NewDumper: maxDelay must be positive, not [%s]", maxDelay)
+	} else if queueSize < 0 {
+		return nil, fmt.Errorf("groupcommit.NewDumper: queueSize must not be negative, not [%d]", queueSize)
+	}
+	gd := &Dumper{
+		Target:   target,
+		MaxSize:  maxSize,
+		MaxDelay: maxDelay,
+		queue:    make(chan pending, queueSize),
+		done:     make(chan struct{}),
+	}
+	go gd.run()
+	return gd, nil
+}
+
+// Dump queues req, and waits until it's been written.
+func (gd *Dumper) Dump(req *storage.Request) error {
+	return gd.DumpContext(context.Background(), req)
+}
+
+// DumpContext is Dump, giving up if ctx is done before req is queued, or before its group
+// is written. Once its group is being written, it waits for the result.
+func (gd *Dumper) DumpContext(ctx context.Context, req *storage.Request) error {
+	p := pending{ctx: ctx, req: req, done: make(chan error, 1)}
+	gd.lock.RLock()
+	if gd.closed {
+		gd.lock.RUnlock()
+		return ErrClosed
+	}
+	select {
+	case gd.queue <- p:
+	case <-ctx.Done():
+		gd.lock.RUnlock()
+		return ctx.Err()
+	}
+	gd.lock.RUnlock()
+	return <-p.done
+}
+
+// Close stops accepting requests, and waits for queued ones to be written.
+// It doesn't close Target.
+func (gd *Dumper) Close() error {
+	gd.lock.Lock()
+	if !gd.closed {
+		gd.closed = true
+		close(gd.queue)
+	}
+	gd.lock.Unlock()
+	<-gd.done
+	return nil
+}
+
+// run collects queued requests into groups, and writes them, until the queue is closed.
+func (gd *Dumper) run() {
+	defer close(gd.done)
+	group := make([]pending, 0, gd.MaxSize)
+	for {
+		p, ok := <-gd.queue
+		if !ok {
+			return
+		}
+		group = append(group[:0], p)
+
+		timer := time.NewTimer(gd.MaxDelay)
+	collect:
+		for len(group) < gd.MaxSize {
+			select {
+			case p, ok = <-gd.queue:
+				if !ok {
+					break collect
+				}
+				group = append(group, p)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		gd.write(group)
+		if !ok {
+			return
+		}
+	}
+}
+
+// write stores a group of requests, and reports the result to each of their callers.
+// Requests whose callers have given up aren't written.
+func (gd *Dumper) write(group []pending) {
+	live := group[:0]
+	for _, p := range group {
+		if err := p.ctx.Err(); err != nil {
+			p.done <- err
+			continue
+		}
+		live = append(live, p)
+	}
+	group = live
+	if len(group) == 0 {
+		return
+	}
+
+	storage.GroupCommitSize.Observe(float64(len(group)))
+	if md, ok := gd.Target.(storage.ManyDumper); ok {
+		reqs := make([]*storage.Request, len(group))
+		for i := range group {
+			reqs[i] = group[i].req
+		}
+		err := md.DumpMany(reqs)
+		if err == nil || len(group) == 1 {
+			for i := range group {
+				group[i].done <- err
+			}
+			return
+		}
+		log.Printf("groupcommit: storing a group of %d one at a time: %s\n", len(group), err)
+	}
+
+	for i := range group {
+		group[i].done <- gd.dump(group[i])
+	}
+}
+
+// dump stores a single request, with its caller's context if Target can use it.
+func (gd *Dumper) dump(p pending) error {
+	if cd, ok := gd.Target.(storage.ContextDumper); ok {
+		return cd.DumpContext(p.ctx, p.req)
+	}
+	return gd.Target.Dump(p.req)
+}
@@ -0,0 +1,192 @@
+package groupcommit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+var errBad = errors.New("bad request")
+
+// oneDumper stores requests one at a time, failing those whose head is "bad".
+type oneDumper struct {
+	lock   sync.Mutex
+	dumped []*storage.Request
+}
+
+func (od *oneDumper) Dump(req *storage.Request) error {
+	if string(req.Head) == "bad" {
+		return errBad
+	}
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	od.dumped = append(od.dumped, req)
+	return nil
+}
+
+func (od *oneDumper) count() int {
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	return len(od.dumped)
+}
+
+// manyDumper is a oneDumper that also stores groups, which fail if any request in them is bad.
+type manyDumper struct {
+	oneDumper
+	groups []int
+}
+
+func (md *manyDumper) DumpMany(reqs []*storage.Request) error {
+	md.lock.Lock()
+	md.groups = append(md.groups, len(reqs))
+	md.lock.Unlock()
+	for _, req := range reqs {
+		if string(req.Head) == "bad" {
+			return errBad
+		}
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.dumped = append(md.dumped, reqs...)
+	return nil
+}
+
+func (md *manyDumper) groupSizes() []int {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return append([]int(nil), md.groups...)
+}
+
+// dumpAll calls Dump with a request for each head at once, and returns each call's error.
+func dumpAll(gd *Dumper, heads ...string) []error {
+	errs := make([]error, len(heads))
+	var wg sync.WaitGroup
+	for i, head := range heads {
+		wg.Add(1)
+		go func(i int, head string) {
+			defer wg.Done()
+			errs[i] = gd.Dump(&storage.Request{Head: []byte(head), When: time.Now()})
+		}(i, head)
+	}
+	wg.Wait()
+	return errs
+}
+
+func newDumper(t *testing.T, target storage.Dumper, maxSize int, maxDelay time.Duration) *Dumper {
+	t.Helper()
+	gd, err := NewDumper(target, maxSize, maxDelay, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gd.Close() })
+	return gd
+}
+
+func TestMaxSize(t *testing.T) {
+	md := &manyDumper{}
+	// The delay never runs out, so groups are only written once they're full.
+	gd := newDumper(t, md, 3, time.Hour)
+	for i, err := range dumpAll(gd, "a", "b", "c", "d", "e", "f") {
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	sizes := md.groupSizes()
+	if len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 3 {
+		t.Fatalf("group sizes %v, want [3 3]", sizes)
+	}
+}
+
+func TestMaxDelay(t *testing.T) {
+	md := &manyDumper{}
+	gd := newDumper(t, md, 100, 20*time.Millisecond)
+	start := time.Now()
+	if err := gd.Dump(&storage.Request{Head: []byte("a"), When: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("partial group written after %s", elapsed)
+	}
+	if sizes := md.groupSizes(); len(sizes) != 1 || sizes[0] != 1 {
+		t.Fatalf("group sizes %v, want [1]", sizes)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	md := &manyDumper{}
+	gd := newDumper(t, md, 4, time.Hour)
+	// The group fails, so its requests are retried one at a time, and only the bad ones fail.
+	errs := dumpAll(gd, "a", "bad", "b", "bad")
+	for i, want := range []error{nil, errBad, nil, errBad} {
+		if !errors.Is(errs[i], want) {
+			t.Errorf("request %d: got %v, want %v", i, errs[i], want)
+		}
+	}
+	if n := md.count(); n != 2 {
+		t.Errorf("stored %d requests, want 2", n)
+	}
+
+	// A group of one isn't retried, and its caller gets the group's error.
+	md = &manyDumper{}
+	gd = newDumper(t, md, 100, time.Millisecond)
+	if err := gd.Dump(&storage.Request{Head: []byte("bad"), When: time.Now()}); !errors.Is(err, errBad) {
+		t.Fatalf("got %v, want %v", err, errBad)
+	}
+}
+
+func TestCloseDrains(t *testing.T) {
+	md := &manyDumper{}
+	gd, err := NewDumper(md, 100, time.Hour, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	finished := make(chan struct{})
+	go func() {
+		errs = dumpAll(gd, "a", "b", "c", "d", "e")
+		close(finished)
+	}()
+	// Give the requests time to be queued; the delay would hold them for an hour.
+	time.Sleep(50 * time.Millisecond)
+	if err = gd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dump calls still waiting after Close")
+	}
+
+	stored := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case !errors.Is(err, ErrClosed):
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	if stored == 0 || stored != md.count() {
+		t.Fatalf("%d calls succeeded, %d requests stored", stored, md.count())
+	}
+	if err = gd.Dump(&storage.Request{Head: []byte("f"), When: time.Now()}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Dump after Close: got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestOneAtATime(t *testing.T) {
+	od := &oneDumper{}
+	gd := newDumper(t, od, 4, time.Hour)
+	errs := dumpAll(gd, "a", "b", "bad", "c")
+	for i, want := range []error{nil, nil, errBad, nil} {
+		if !errors.Is(errs[i], want) {
+			t.Errorf("request %d: got %v, want %v", i, errs[i], want)
+		}
+	}
+	if n := od.count(); n != 3 {
+		t.Fatalf("stored %d requests, want 3", n)
+	}
+}
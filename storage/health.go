@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Pinger is implemented by backends that can check whether their storage is reachable.
+type Pinger interface {
+	Ping() error
+}
+
+// lastBatch holds the time, in Unix nanoseconds, when ProcessBatch last returned without error.
+// It starts out as the time the program started, so a new process isn't reported as stalled.
+var lastBatch = time.Now().UnixNano()
+
+func setLastBatch(t time.Time) {
+	atomic.StoreInt64(&lastBatch, t.UnixNano())
+}
+
+// LastBatch returns the time when ProcessBatch last completed without error,
+// whether or not there were any requests to process.
+func LastBatch() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&lastBatch))
+}
+
+// HealthzHandler reports that the process is alive, suitable for a liveness check.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readiness is the body returned by the handler from ReadyzFactory.
+type Readiness struct {
+	Ready          bool      `json:"ready"`
+	Storage        string    `json:"storage"`
+	LastBatch      time.Time `json:"last_batch"`
+	LastBatchAge   float64   `json:"last_batch_age_seconds"`
+	BatchesStalled bool      `json:"batches_stalled"`
+	// Role is "leader" or "follower", when batch processing is coordinated by an Elector.
+	Role        string     `json:"role,omitempty"`
+	LeaderSince *time.Time `json:"leader_since,omitempty"`
+}
+
+// ReadyzFactory returns a handler function suitable for a readiness check.
+// It responds with 503 Service Unavailable when p can't reach its storage, or when
+// ProcessBatch hasn't completed successfully within maxStall. A maxStall of zero
+// disables the stall check. If e is set, followers are never reported as stalled,
+// and a new leader isn't stalled until maxStall after it took over.
+func ReadyzFactory(p Pinger, maxStall time.Duration, e Elector) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		last := LastBatch()
+		age := time.Since(last)
+		rd := &Readiness{
+			Ready:        true,
+			Storage:      "ok",
+			LastBatch:    last,
+			LastBatchAge: age.Seconds(),
+		}
+
+		if err := p.Ping(); err != nil {
+			rd.Ready = false
+			rd.Storage = err.Error()
+		}
+		stalled := maxStall > 0 && age > maxStall
+		if e != nil {
+			leading, since := e.Leading()
+			if leading {
+				rd.Role = "leader"
+				rd.LeaderSince = &since
+				stalled = stalled && time.Since(since) > maxStall
+			} else {
+				rd.Role = "follower"
+				stalled = false
+			}
+		}
+		if stalled {
+			rd.Ready = false
+			rd.BatchesStalled = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !rd.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rd)
+	}
+}
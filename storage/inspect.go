@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Inspector methods when the requested item doesn't exist.
+var ErrNotFound = errors.New("storage: not found")
+
+// ErrNotSupported is returned by Inspector methods that a backend can't implement.
+var ErrNotSupported = errors.New("storage: not supported by this backend")
+
+// State describes where a stored request is in processing.
+type State string
+
+const (
+	// StatePending requests are waiting to be included in a batch.
+	StatePending State = "pending"
+	// StateBatched requests are in a batch that hasn't been marked done.
+	StateBatched State = "batched"
+	// StateDone requests have been processed, and are kept by a backend's retention mode.
+	StateDone State = "done"
+)
+
+// Filter selects stored requests. Zero-valued fields match everything.
+type Filter struct {
+	State  State
+	Batch  int64
+	After  time.Time
+	Before time.Time
+	MinID  int64
+	MaxID  int64
+}
+
+// IsZero reports whether the filter matches every request.
+func (f *Filter) IsZero() bool {
+	return *f == Filter{}
+}
+
+// Match reports whether req is selected by the filter, for backends that filter in Go.
+func (f *Filter) Match(req *Request) bool {
+	batched := req.Batch != nil && *req.Batch != 0
+	switch f.State {
+	case StatePending:
+		if batched {
+			return false
+		}
+	case StateBatched:
+		if !batched || req.Done != nil {
+			return false
+		}
+	case StateDone:
+		if req.Done == nil {
+			return false
+		}
+	}
+	if f.Batch != 0 && (!batched || int64(*req.Batch) != f.Batch) {
+		return false
+	}
+	if !f.After.IsZero() && req.When.Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !req.When.Before(f.Before) {
+		return false
+	}
+	if req.ID != nil {
+		if f.MinID != 0 && *req.ID < f.MinID {
+			return false
+		}
+		if f.MaxID != 0 && *req.ID > f.MaxID {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterColumns names the columns a SQL backend uses for fields used by Filter.
+type FilterColumns struct {
+	ID    string
+	When  string
+	Batch string
+	// Done, if set, holds when a processed request's batch was marked done.
+	// Backends without a retention mode leave it empty, and never match StateDone.
+	Done string
+	// TimeCompare, if set, is a format string wrapping both the When column and
+	// time arguments before they're compared, such as "julianday(%s)".
+	TimeCompare string
+}
+
+// SQL returns a WHERE clause (without the WHERE keyword) for the filter, using
+// numbered placeholders that follow any arguments already in args.
+// The returned clause is "TRUE" if the filter matches every request.
+func (f *Filter) SQL(cols FilterColumns, args []interface{}) (string, []interface{}) {
+	conds := make([]string, 0, 6)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	switch f.State {
+	case StatePending:
+		conds = append(conds, fmt.Sprintf("(%s = 0 OR %s IS NULL)", cols.Batch, cols.Batch))
+	case StateBatched:
+		conds = append(conds, fmt.Sprintf("%s > 0", cols.Batch))
+		if cols.Done != "" {
+			conds = append(conds, fmt.Sprintf("%s IS NULL", cols.Done))
+		}
+	case StateDone:
+		if cols.Done == "" {
+			conds = append(conds, "FALSE")
+		} else {
+			conds = append(conds, fmt.Sprintf("%s IS NOT NULL", cols.Done))
+		}
+	}
+	if f.Batch != 0 {
+		conds = append(conds, fmt.Sprintf("%s = %s", cols.Batch, arg(f.Batch)))
+	}
+	when := func(s string) string {
+		if cols.TimeCompare == "" {
+			return s
+		}
+		return fmt.Sprintf(cols.TimeCompare, s)
+	}
+	if !f.After.IsZero() {
+		conds = append(conds, fmt.Sprintf("%s >= %s", when(cols.When), when(arg(f.After))))
+	}
+	if !f.Before.IsZero() {
+		conds = append(conds, fmt.Sprintf("%s < %s", when(cols.When), when(arg(f.Before))))
+	}
+	if f.MinID != 0 {
+		conds = append(conds, fmt.Sprintf("%s >= %s", cols.ID, arg(f.MinID)))
+	}
+	if f.MaxID != 0 {
+		conds = append(conds, fmt.Sprintf("%s <= %s", cols.ID, arg(f.MaxID)))
+	}
+
+	if len(conds) == 0 {
+		return "TRUE", args
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// BatchStatus summarizes a batch that hasn't been marked done.
+type BatchStatus struct {
+	ID       int64     `json:"id"`
+	Requests int64     `json:"requests"`
+	Oldest   time.Time `json:"oldest"`
+	Newest   time.Time `json:"newest"`
+}
+
+// Inspector is implemented by backends that allow stored requests to be examined
+// and managed outside of the normal MarkBatch, ReadRequests, BatchDone cycle.
+type Inspector interface {
+	// ListRequests returns requests matching f, ordered by ID.
+	ListRequests(f Filter, offset, limit int) ([]Request, error)
+	// GetRequest returns ErrNotFound if there's no request with the given ID.
+	GetRequest(id int64) (*Request, error)
+	// Batches returns every batch that hasn't been marked done, ordered by ID.
+	Batches() ([]BatchStatus, error)
+	// RequeueBatch moves the requests in a batch back to pending, returning how many were moved.
+	RequeueBatch(batchID int64) (int64, error)
+	// DeleteRequests deletes requests matching f, returning how many were deleted.
+	DeleteRequests(f Filter) (int64, error)
+}
+
+// Purger is implemented by backends with a retention mode, which keep requests
+// after their batch is marked done instead of deleting them.
+type Purger interface {
+	// Purge deletes requests whose batch was marked done before t, returning how many were deleted.
+	Purge(t time.Time) (int64, error)
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics, registered with the default registry.
+// Serve them with promhttp.Handler() from github.com/prometheus/client_golang/prometheus/promhttp.
+var (
+	RequestsDumped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpdump_requests_dumped_total",
+		Help: "Incoming requests stored by a Dumper.",
+	})
+	RequestsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpdump_requests_rejected_total",
+		Help: "Incoming requests that couldn't be stored, by reason.",
+	}, []string{"reason"})
+	Batches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpdump_batches_total",
+		Help: "Batches processed successfully.",
+	})
+	BatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "httpdump_batch_size_requests",
+		Help:    "Number of requests in each processed batch.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	ProcessBatchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "httpdump_process_batch_duration_seconds",
+		Help:    "Time taken by ProcessBatch, for calls that found a batch.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+	ProcessorErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpdump_processor_errors_total",
+		Help: "Errors returned by Processor.ProcessRequests.",
+	})
+	BackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "httpdump_backend_duration_seconds",
+		Help:    "Time taken by storage backend operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "op"})
+	RequestsPurged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpdump_requests_purged_total",
+		Help: "Processed requests deleted by the retention sweeper.",
+	})
+	BackendRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpdump_backend_retries_total",
+		Help: "Storage backend operations retried after a transient error.",
+	}, []string{"backend", "op"})
+	BackendRetriesExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpdump_backend_retries_exhausted_total",
+		Help: "Storage backend operations that failed with a transient error after running out of retries.",
+	}, []string{"backend", "op"})
+	Leading = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "httpdump_leader",
+		Help: "1 while this process is the elected batch processing leader, 0 otherwise.",
+	})
+	GroupCommitSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "httpdump_group_commit_size_requests",
+		Help:    "Number of requests written together by a group-commit Dumper.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(RequestsDumped, RequestsRejected, Batches, BatchSize,
+		ProcessBatchDuration, ProcessorErrors, BackendDuration, RequestsPurged,
+		GroupCommitSize, BackendRetries, BackendRetriesExhausted, Leading)
+}
+
+// TimeBackend starts timing a backend operation, and returns a function that records it.
+// Typical usage is:
+//
+//	defer storage.TimeBackend("pg", "dump")()
+func TimeBackend(backend, op string) func() {
+	start := time.Now()
+	return func() {
+		BackendDuration.WithLabelValues(backend, op).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Backlogger is implemented by backends that can report how much stored data is still unprocessed,
+// either waiting for a batch or in a batch that isn't done yet.
+type Backlogger interface {
+	Backlog() (pending int64, oldest time.Time, err error)
+}
+
+var (
+	pendingDesc = prometheus.NewDesc("httpdump_pending_requests",
+		"Stored requests that haven't been processed yet.", nil, nil)
+	oldestPendingDesc = prometheus.NewDesc("httpdump_oldest_pending_age_seconds",
+		"Age of the oldest stored request that hasn't been processed yet.", nil, nil)
+)
+
+type backlogCollector struct {
+	b Backlogger
+}
+
+// NewBacklogCollector returns a prometheus.Collector that queries the backlog of b on each scrape.
+func NewBacklogCollector(b Backlogger) prometheus.Collector {
+	return &backlogCollector{b: b}
+}
+
+func (bc *backlogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingDesc
+	ch <- oldestPendingDesc
+}
+
+func (bc *backlogCollector) Collect(ch chan<- prometheus.Metric) {
+	pending, oldest, err := bc.b.Backlog()
+	if err != nil {
+		log.Printf("storage.Backlog: %s\n", err)
+		ch <- prometheus.NewInvalidMetric(pendingDesc, err)
+		return
+	}
+	var age float64
+	if pending > 0 && !oldest.IsZero() {
+		age = time.Since(oldest).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(pending))
+	ch <- prometheus.MustNewConstMetric(oldestPendingDesc, prometheus.GaugeValue, age)
+}
@@ -3,69 +3,147 @@ package pg
 import (
 	"database/sql"
 	"fmt"
-	"regexp"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// PGConfig describes how to connect to PostgreSQL. If Url is set, it's used as the connection
+// string, and the connection fields are ignored. Empty fields are left to libpq's defaults.
 type PGConfig struct {
 	Db   string
 	User string
 	Pass string
+	Host string
+	Port int
+	// SSLMode is one of libpq's sslmode values, such as "disable", "require" or "verify-full".
+	SSLMode     string
+	SSLRootCert string
+	// ConnectTimeout is rounded up to whole seconds.
+	ConnectTimeout time.Duration
+	// Opts holds any other libpq connection parameters.
 	Opts map[string]string
 	Url  string
-}
-
-var whitespace *regexp.Regexp = regexp.MustCompile(`\s`)
-
-func (cfg *PGConfig) Connect() (*sql.DB, error) {
-	var dsn string
-	if cfg.Url != "" {
-		dsn = cfg.Url
 
-	} else {
-		opts := make([]string, 0, 3)
-
-		if cfg.Db != "" {
-			if whitespace.MatchString(cfg.Db) {
-				return nil, fmt.Errorf("whitespace in database names is not supported")
-			}
-			opts = append(opts, fmt.Sprintf("dbname=%s", cfg.Db))
-		}
+	// Pool settings, applied to the handle returned by Connect. Zero values keep database/sql's defaults.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
 
-		if cfg.User != "" {
-			if whitespace.MatchString(cfg.User) {
-				return nil, fmt.Errorf("whitespace in user names is not supported")
-			}
-			opts = append(opts, fmt.Sprintf("user=%s", cfg.User))
+// LoadEnv fills in empty fields from the standard libpq environment variables:
+// PGHOST, PGPORT, PGDATABASE, PGUSER, PGPASSWORD, PGSSLMODE, PGSSLROOTCERT and PGCONNECT_TIMEOUT.
+func (cfg *PGConfig) LoadEnv() error {
+	setEnv := func(field *string, name string) {
+		if *field == "" {
+			*field = os.Getenv(name)
 		}
+	}
+	setEnv(&cfg.Host, "PGHOST")
+	setEnv(&cfg.Db, "PGDATABASE")
+	setEnv(&cfg.User, "PGUSER")
+	setEnv(&cfg.Pass, "PGPASSWORD")
+	setEnv(&cfg.SSLMode, "PGSSLMODE")
+	setEnv(&cfg.SSLRootCert, "PGSSLROOTCERT")
 
-		if cfg.Pass != "" {
-			if whitespace.MatchString(cfg.Pass) {
-				return nil, fmt.Errorf("whitespace in passwords is not supported")
-			}
-			opts = append(opts, fmt.Sprintf("password=%s", cfg.Pass))
+	if v := os.Getenv("PGPORT"); cfg.Port == 0 && v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("pg.LoadEnv: invalid PGPORT [%s]", v)
 		}
-
-		for k, v := range cfg.Opts {
-			if whitespace.MatchString(k) {
-				return nil, fmt.Errorf("whitespace in option names is not supported: [%s]", k)
-			} else if whitespace.MatchString(v) {
-				return nil, fmt.Errorf("whitespace in option values is not supported: [%s] (%s)", v, k)
-			}
-			opts = append(opts, fmt.Sprintf("%s=%s", k, v))
+		cfg.Port = port
+	}
+	if v := os.Getenv("PGCONNECT_TIMEOUT"); cfg.ConnectTimeout == 0 && v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("pg.LoadEnv: invalid PGCONNECT_TIMEOUT [%s]", v)
 		}
+		cfg.ConnectTimeout = time.Duration(secs) * time.Second
+	}
+	return nil
+}
 
-		dsn = strings.Join(opts, " ")
+func (cfg *PGConfig) Connect() (*sql.DB, error) {
+	dsn, err := cfg.DSN()
+	if err != nil {
+		return nil, err
 	}
 
 	dbh, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.MaxOpenConns > 0 {
+		dbh.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		dbh.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		dbh.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
 
 	return dbh, nil
 }
 
+// DSN returns the connection string used by Connect, which is also needed
+// by connections opened outside of database/sql, such as pq.NewListener.
+func (cfg *PGConfig) DSN() (string, error) {
+	if cfg.Url != "" {
+		return cfg.Url, nil
+	}
+
+	params := map[string]string{}
+	for k, v := range cfg.Opts {
+		if k == "" || strings.ContainsAny(k, "= \t\r\n'\\") {
+			return "", fmt.Errorf("pg.DSN: invalid option name [%s]", k)
+		}
+		params[k] = v
+	}
+	set := func(k, v string) {
+		if v != "" {
+			params[k] = v
+		}
+	}
+	set("dbname", cfg.Db)
+	set("user", cfg.User)
+	set("password", cfg.Pass)
+	set("host", cfg.Host)
+	set("sslmode", cfg.SSLMode)
+	set("sslrootcert", cfg.SSLRootCert)
+	if cfg.Port != 0 {
+		params["port"] = strconv.Itoa(cfg.Port)
+	}
+	if cfg.ConnectTimeout > 0 {
+		secs := (cfg.ConnectTimeout + time.Second - 1) / time.Second
+		params["connect_timeout"] = strconv.Itoa(int(secs))
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, quoteValue(params[k])))
+	}
+	return strings.Join(pairs, " "), nil
+}
+
+// dsnEscaper escapes backslashes and single quotes in libpq connection parameter values.
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteValue quotes a libpq keyword/value connection parameter value, if it needs it.
+func quoteValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n\f\v'\\") {
+		return v
+	}
+	return "'" + dsnEscaper.Replace(v) + "'"
+}
+
 func SchemaExists(dbh *sql.DB, schema string) (bool, error) {
 	exists := false
 	row := dbh.QueryRow(`
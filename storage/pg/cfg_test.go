@@ -0,0 +1,66 @@
+package pg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuoteValue(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"plain", "secret", "secret"},
+		{"empty", "", "''"},
+		{"space", "two words", "'two words'"},
+		{"tab", "a\tb", "'a\tb'"},
+		{"quote", "it's", `'it\'s'`},
+		{"backslash", `a\b`, `'a\\b'`},
+		{"quote and backslash", `\'`, `'\\\''`},
+		{"equals", "a=b", "a=b"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := quoteValue(c.in); got != c.want {
+				t.Errorf("quoteValue(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDSN(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		cfg  PGConfig
+		want string
+	}{
+		{"empty", PGConfig{}, ""},
+		{"url", PGConfig{Url: "postgres://u@h/db", Pass: "ignored"}, "postgres://u@h/db"},
+		{"fields", PGConfig{Db: "httpdump", User: "dumper", Host: "db.example.com", Port: 5433, SSLMode: "require"},
+			"dbname=httpdump host=db.example.com port=5433 sslmode=require user=dumper"},
+		{"password with space", PGConfig{User: "u", Pass: "two words"}, "password='two words' user=u"},
+		{"password with quote", PGConfig{Pass: "it's"}, `password='it\'s'`},
+		{"password with backslash", PGConfig{Pass: `a\b`}, `password='a\\b'`},
+		{"password with equals", PGConfig{Pass: "a=b"}, "password=a=b"},
+		{"empty option", PGConfig{Opts: map[string]string{"application_name": ""}}, "application_name=''"},
+		{"timeout rounds up", PGConfig{ConnectTimeout: 1500 * time.Millisecond}, "connect_timeout=2"},
+		{"fields override opts", PGConfig{User: "u", Opts: map[string]string{"user": "other"}}, "user=u"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.cfg.DSN()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("DSN() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDSNInvalidOption(t *testing.T) {
+	for _, k := range []string{"", "a=b", "a b", "it's", `a\b`} {
+		cfg := PGConfig{Opts: map[string]string{k: "v"}}
+		if dsn, err := cfg.DSN(); err == nil {
+			t.Errorf("option name %q: got DSN %q, want an error", k, dsn)
+		}
+	}
+}
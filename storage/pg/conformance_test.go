@@ -0,0 +1,45 @@
+package pg
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/storagetest"
+)
+
+// TestConformance needs a PostgreSQL database, given by HTTPDUMP_TEST_PG_URL.
+// Each check uses its own schema, which is dropped afterwards.
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("HTTPDUMP_TEST_PG_URL")
+	if dsn == "" {
+		t.Skip("HTTPDUMP_TEST_PG_URL isn't set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	// Heads and bodies are stored as text, which can't hold NUL bytes or invalid UTF-8.
+	storagetest.Run(t, func(t *testing.T) storage.DumpBatcher {
+		schema := fmt.Sprintf("httpdump_test_%d", time.Now().UnixNano())
+		dbh, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = SchemaInit(dbh, schema); err != nil {
+			dbh.Close()
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if _, err := admin.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema)); err != nil {
+				t.Errorf("DROP SCHEMA: %s", err)
+			}
+		})
+		return &PgDumper{Schema: schema, Dbh: dbh, DSN: dsn}
+	}, "BinaryData")
+}
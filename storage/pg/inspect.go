@@ -0,0 +1,137 @@
+package pg
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/lib/pq"
+)
+
+var filterColumns = storage.FilterColumns{ID: "request_id", When: `"when"`, Batch: "batch_id", Done: "done_at"}
+
+// scanRequests reads rows of (request_id, head, data, "when", batch_id, done_at).
+func scanRequests(rows *sql.Rows) ([]storage.Request, error) {
+	reqs := make([]storage.Request, 0, 32)
+	for rows.Next() {
+		var id int64
+		var batch sql.NullInt64
+		var done pq.NullTime
+		req := storage.Request{}
+		err := rows.Scan(&id, &req.Head, &req.Data, &req.When, &batch, &done)
+		if err != nil {
+			return nil, err
+		}
+		req.ID = &id
+		if batch.Valid && batch.Int64 != 0 {
+			b := int(batch.Int64)
+			req.Batch = &b
+		}
+		if done.Valid {
+			req.Done = &done.Time
+		}
+		reqs = append(reqs, req)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+func (pd *PgDumper) ListRequests(f storage.Filter, offset, limit int) ([]storage.Request, error) {
+	where, args := f.SQL(filterColumns, nil)
+	var lim sql.NullInt64
+	if limit > 0 {
+		lim = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	args = append(args, lim, offset)
+
+	rows, err := pd.Dbh.Query(fmt.Sprintf(`
+		SELECT request_id, head, data, "when", batch_id, done_at
+		  FROM %s.raw_requests
+		 WHERE %s
+		 ORDER BY request_id ASC
+		 LIMIT $%d OFFSET $%d
+	`, pd.Schema, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("pg.ListRequests (SELECT): %w", err)
+	}
+	defer rows.Close()
+
+	reqs, err := scanRequests(rows)
+	if err != nil {
+		return nil, fmt.Errorf("pg.ListRequests (Scan): %w", err)
+	}
+	return reqs, nil
+}
+
+func (pd *PgDumper) GetRequest(id int64) (*storage.Request, error) {
+	rows, err := pd.Dbh.Query(fmt.Sprintf(`
+		SELECT request_id, head, data, "when", batch_id, done_at
+		  FROM %s.raw_requests
+		 WHERE request_id = $1
+	`, pd.Schema), id)
+	if err != nil {
+		return nil, fmt.Errorf("pg.GetRequest (SELECT): %w", err)
+	}
+	defer rows.Close()
+
+	reqs, err := scanRequests(rows)
+	if err != nil {
+		return nil, fmt.Errorf("pg.GetRequest (Scan): %w", err)
+	}
+	if len(reqs) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return &reqs[0], nil
+}
+
+func (pd *PgDumper) Batches() ([]storage.BatchStatus, error) {
+	rows, err := pd.Dbh.Query(fmt.Sprintf(`
+		SELECT batch_id, count(*), min("when"), max("when")
+		  FROM %s.raw_requests
+		 WHERE batch_id > 0 AND done_at IS NULL
+		 GROUP BY batch_id
+		 ORDER BY batch_id ASC
+	`, pd.Schema))
+	if err != nil {
+		return nil, fmt.Errorf("pg.Batches (SELECT): %w", err)
+	}
+	defer rows.Close()
+
+	batches := make([]storage.BatchStatus, 0, 4)
+	for rows.Next() {
+		b := storage.BatchStatus{}
+		err = rows.Scan(&b.ID, &b.Requests, &b.Oldest, &b.Newest)
+		if err != nil {
+			return nil, fmt.Errorf("pg.Batches (Scan): %w", err)
+		}
+		batches = append(batches, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pg.Batches (Err): %w", err)
+	}
+	return batches, nil
+}
+
+func (pd *PgDumper) RequeueBatch(batchID int64) (int64, error) {
+	res, err := pd.Dbh.Exec(fmt.Sprintf(`
+		UPDATE %s.raw_requests SET batch_id = NULL
+		 WHERE batch_id = $1 AND done_at IS NULL
+	`, pd.Schema), batchID)
+	if err != nil {
+		return 0, fmt.Errorf("pg.RequeueBatch (UPDATE): %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (pd *PgDumper) DeleteRequests(f storage.Filter) (int64, error) {
+	where, args := f.SQL(filterColumns, nil)
+	res, err := pd.Dbh.Exec(fmt.Sprintf(`
+		DELETE FROM %s.raw_requests WHERE %s
+	`, pd.Schema, where), args...)
+	if err != nil {
+		return 0, fmt.Errorf("pg.DeleteRequests (DELETE): %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,124 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// Leader elects one of several processes sharing a schema to process batches. The leader holds
+// a session-level advisory lock, keyed on the schema, on a connection of its own. If the leader's
+// session dies, PostgreSQL releases the lock, and another process takes it on its next attempt.
+// A leader cut off from the server notices within about an Interval, so for a moment two processes
+// may both think they're leading; MarkBatch's SKIP LOCKED keeps their batches apart.
+type Leader struct {
+	Dbh    *sql.DB
+	Schema string
+	// Interval is how often a follower tries to take the lock, and the leader checks its connection.
+	// Defaults to five seconds.
+	Interval time.Duration
+
+	// lock guards conn and since for Leading. Only Campaign changes them, so it reads them
+	// without the lock, and holds it only to update them, never during network I/O.
+	lock  sync.Mutex
+	conn  *sql.Conn
+	since time.Time
+}
+
+// key returns the advisory lock key for the schema.
+func (l *Leader) key() int64 {
+	h := fnv.New64a()
+	h.Write([]byte("httpdump:" + l.Schema))
+	return int64(h.Sum64())
+}
+
+// Leading reports whether this process is the leader, and since when.
+func (l *Leader) Leading() (bool, time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.conn != nil, l.since
+}
+
+// Campaign tries to become the leader, and checks that it still is, every Interval until ctx is done.
+// It then steps down, so another process can take over right away.
+func (l *Leader) Campaign(ctx context.Context) {
+	interval := l.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		l.check(ctx, interval)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if l.conn != nil {
+				log.Printf("pg.Leader: stepping down for schema [%s]\n", l.Schema)
+				l.resign()
+			}
+			return
+		}
+	}
+}
+
+// check makes sure the leader's connection is still alive, or tries to take the lock if there's no leader.
+func (l *Leader) check(ctx context.Context, timeout time.Duration) {
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if l.conn != nil {
+		err := l.conn.PingContext(cctx)
+		if err == nil {
+			return
+		}
+		log.Printf("pg.Leader: lost leadership for schema [%s]: %s\n", l.Schema, err)
+		l.resign()
+	}
+
+	conn, err := l.Dbh.Conn(cctx)
+	if err != nil {
+		log.Printf("pg.Leader (Conn): %s\n", err)
+		return
+	}
+	var locked bool
+	err = conn.QueryRowContext(cctx, `SELECT pg_try_advisory_lock($1)`, l.key()).Scan(&locked)
+	if err != nil || !locked {
+		if err != nil {
+			log.Printf("pg.Leader (SELECT): %s\n", err)
+		}
+		discard(conn)
+		return
+	}
+	log.Printf("pg.Leader: leading for schema [%s]\n", l.Schema)
+	l.lock.Lock()
+	l.conn = conn
+	l.since = time.Now()
+	l.lock.Unlock()
+	storage.Leading.Set(1)
+}
+
+// resign gives up leadership, and then closes the leader's connection.
+func (l *Leader) resign() {
+	l.lock.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.since = time.Time{}
+	l.lock.Unlock()
+	storage.Leading.Set(0)
+	discard(conn)
+}
+
+// discard closes conn's session, rather than returning it to the pool, which releases
+// any advisory locks it holds, even if the server can't be reached to unlock them.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
@@ -0,0 +1,317 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Partitioning configures a raw_requests table that's partitioned by "when", so old requests
+// can be removed by dropping whole partitions, instead of deleting (and vacuuming) row by row.
+// Requests that don't fall in any partition are stored in raw_requests_default.
+type Partitioning struct {
+	// Interval is how much time each partition covers: "day" or "month".
+	Interval string
+	// Ahead is how many partitions after the current one are created in advance. It must be
+	// at least 1, so requests arriving around a boundary, or from a skewed clock, have a partition.
+	Ahead int
+}
+
+// partitionLayouts are the formats of partition name suffixes, by Interval.
+var partitionLayouts = map[string]string{
+	"day":   "20060102",
+	"month": "200601",
+}
+
+// Validate checks that the partitioning can be used.
+func (p *Partitioning) Validate() error {
+	if _, ok := partitionLayouts[p.Interval]; !ok {
+		return fmt.Errorf("pg.Partitioning: interval must be `day` or `month`, not [%s]", p.Interval)
+	} else if p.Ahead < 1 {
+		return fmt.Errorf("pg.Partitioning: ahead must be at least 1, not [%d]", p.Ahead)
+	}
+	return nil
+}
+
+// start returns the beginning of the partition containing t.
+func (p *Partitioning) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p.Interval == "month" {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// next returns the beginning of the partition after the one starting at start.
+func (p *Partitioning) next(start time.Time) time.Time {
+	if p.Interval == "month" {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func (p *Partitioning) name(start time.Time) string {
+	return "raw_requests_p" + start.Format(partitionLayouts[p.Interval])
+}
+
+// SchemaInitPartitioned is like SchemaInit, but creates raw_requests partitioned by "when",
+// along with partitions for the current interval and the ones Ahead of it.
+// It returns an error if raw_requests already exists and isn't partitioned.
+// Declarative partitioning requires PostgreSQL 11 or later.
+func SchemaInitPartitioned(dbh *sql.DB, schema string, p *Partitioning) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := schemaInit(dbh, schema, p); err != nil {
+		return err
+	}
+	return p.ensure(dbh, schema, time.Now())
+}
+
+// createPartitioned creates raw_requests as a partitioned table, with a default partition.
+func createPartitioned(dbh *sql.DB, schema string) error {
+	ddls := []string{
+		fmt.Sprintf(`
+			CREATE TABLE %s.raw_requests (
+				request_id bigserial,
+				head       text,
+				data       text,
+				"when"     timestamptz not null,
+				batch_id   bigint,
+				done_at    timestamptz,
+				primary key (request_id, "when")
+			) PARTITION BY RANGE ("when")
+		`, pq.QuoteIdentifier(schema)),
+		fmt.Sprintf("CREATE INDEX raw_requests_batch_id_idx ON %s.raw_requests (batch_id)",
+			pq.QuoteIdentifier(schema)),
+		fmt.Sprintf("CREATE TABLE %s.raw_requests_default PARTITION OF %s.raw_requests DEFAULT",
+			pq.QuoteIdentifier(schema), pq.QuoteIdentifier(schema)),
+	}
+	for _, ddl := range ddls {
+		_, err := dbh.Exec(ddl)
+		if err != nil {
+			return fmt.Errorf("pg.SchemaInit: %w", err)
+		}
+	}
+	return nil
+}
+
+// isPartitioned reports whether raw_requests in schema is a partitioned table.
+func isPartitioned(dbh *sql.DB, schema string) (bool, error) {
+	var partitioned bool
+	row := dbh.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM pg_partitioned_table pt
+			  JOIN pg_class c ON c.oid = pt.partrelid
+			  JOIN pg_namespace n ON n.oid = c.relnamespace
+			 WHERE n.nspname = $1 AND c.relname = 'raw_requests'
+		)`, schema)
+	if err := row.Scan(&partitioned); err != nil {
+		return false, fmt.Errorf("pg.SchemaInit: %w", err)
+	}
+	return partitioned, nil
+}
+
+// ensure creates any missing partitions, from the one containing now through Ahead more.
+// It keeps going past a partition it can't create, and returns the first error.
+func (p *Partitioning) ensure(dbh *sql.DB, schema string, now time.Time) error {
+	var first error
+	start := p.start(now)
+	for i := 0; i <= p.Ahead; i++ {
+		end := p.next(start)
+		if err := p.create(dbh, schema, start, end); err != nil && first == nil {
+			first = err
+		}
+		start = end
+	}
+	return first
+}
+
+// create creates the partition from start to end, if it doesn't exist yet. If the default
+// partition already holds requests in that range, they're moved into the new partition.
+func (p *Partitioning) create(dbh *sql.DB, schema string, start, end time.Time) error {
+	create := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.%s PARTITION OF %s.raw_requests
+		   FOR VALUES FROM ('%s') TO ('%s')
+	`, pq.QuoteIdentifier(schema), p.name(start), pq.QuoteIdentifier(schema),
+		start.Format(time.RFC3339), end.Format(time.RFC3339))
+	_, err := dbh.Exec(create)
+	var pqErr *pq.Error
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &pqErr) || pqErr.Code != "23514" { // check_violation
+		return fmt.Errorf("pg.Partitioning (CREATE): %w", err)
+	}
+
+	tx, err := dbh.Begin()
+	if err != nil {
+		return fmt.Errorf("pg.Partitioning (BEGIN): %w", err)
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		fmt.Sprintf(`CREATE TEMPORARY TABLE moved (LIKE %s.raw_requests) ON COMMIT DROP`, pq.QuoteIdentifier(schema)),
+		fmt.Sprintf(`
+			WITH del AS (
+				DELETE FROM %s.raw_requests_default
+				 WHERE "when" >= $1 AND "when" < $2
+				RETURNING *
+			)
+			INSERT INTO moved SELECT * FROM del
+		`, pq.QuoteIdentifier(schema)),
+		create,
+		fmt.Sprintf(`INSERT INTO %s.raw_requests SELECT * FROM moved`, pq.QuoteIdentifier(schema)),
+	}
+	for i, stmt := range stmts {
+		if i == 1 {
+			_, err = tx.Exec(stmt, start, end)
+		} else {
+			_, err = tx.Exec(stmt)
+		}
+		if err != nil {
+			return fmt.Errorf("pg.Partitioning (MOVE): %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("pg.Partitioning (COMMIT): %w", err)
+	}
+	log.Printf("pg.Partitioning: moved requests from the default partition into [%s.%s]\n", schema, p.name(start))
+	return nil
+}
+
+// partitions returns the names of raw_requests' partitions, other than the default one.
+func (p *Partitioning) partitions(dbh *sql.DB, schema string) ([]string, error) {
+	rows, err := dbh.Query(`
+		SELECT c.relname FROM pg_inherits i
+		  JOIN pg_class c ON c.oid = i.inhrelid
+		  JOIN pg_class parent ON parent.oid = i.inhparent
+		  JOIN pg_namespace n ON n.oid = parent.relnamespace
+		 WHERE n.nspname = $1 AND parent.relname = 'raw_requests'
+		 ORDER BY c.relname ASC
+	`, schema)
+	if err != nil {
+		return nil, fmt.Errorf("pg.Partitioning (SELECT): %w", err)
+	}
+	defer rows.Close()
+
+	names := make([]string, 0, 8)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("pg.Partitioning (Scan): %w", err)
+		}
+		if strings.HasPrefix(name, "raw_requests_p") {
+			names = append(names, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("pg.Partitioning (Err): %w", err)
+	}
+	return names, nil
+}
+
+// dropIfDone drops a partition if every request in it was marked done before t,
+// and returns how many requests it held. Unprocessed requests are never dropped.
+// Dropping a partition locks raw_requests, so it's checked without locks first, and the
+// lock on raw_requests is taken before the partition's, in the same order as inserts.
+func dropIfDone(ctx context.Context, dbh *sql.DB, schema, name string, t time.Time) (int64, error) {
+	table := fmt.Sprintf("%s.%s", pq.QuoteIdentifier(schema), pq.QuoteIdentifier(name))
+	var total, kept int64
+	row := dbh.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT count(*), count(*) FILTER (WHERE done_at IS NULL OR done_at >= $1)
+		  FROM %s
+	`, table), t)
+	if err := row.Scan(&total, &kept); err != nil {
+		return 0, fmt.Errorf("pg.Purge (SELECT): %w", err)
+	}
+	if kept > 0 {
+		return 0, nil
+	}
+
+	tx, err := dbh.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("pg.Purge (BEGIN): %w", err)
+	}
+	defer tx.Rollback()
+
+	// Keep new requests out while checking again, in case one arrived with an old timestamp.
+	// DROP needs this lock on raw_requests anyway; taking a weaker one first could deadlock on the upgrade.
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s.raw_requests IN ACCESS EXCLUSIVE MODE",
+		pq.QuoteIdentifier(schema)))
+	if err != nil {
+		return 0, fmt.Errorf("pg.Purge (LOCK): %w", err)
+	}
+	row = tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT count(*), count(*) FILTER (WHERE done_at IS NULL OR done_at >= $1)
+		  FROM %s
+	`, table), t)
+	if err = row.Scan(&total, &kept); err != nil {
+		return 0, fmt.Errorf("pg.Purge (SELECT): %w", err)
+	}
+	if kept > 0 {
+		return 0, nil
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", table)); err != nil {
+		return 0, fmt.Errorf("pg.Purge (DROP): %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("pg.Purge (COMMIT): %w", err)
+	}
+	log.Printf("pg.Purge: dropped partition [%s.%s] with %d requests\n", schema, name, total)
+	return total, nil
+}
+
+// purgePartitions creates upcoming partitions, drops old ones whose requests were all
+// marked done before t, and deletes such requests from the default partition.
+func (pd *PgDumper) purgePartitions(t time.Time) (int64, error) {
+	p := pd.Partitioning
+	// Old partitions are still dropped if new ones can't be created; the error is returned at the end.
+	ensureErr := p.ensure(pd.Dbh, pd.Schema, time.Now())
+
+	names, err := p.partitions(pd.Dbh, pd.Schema)
+	if err != nil {
+		return 0, err
+	}
+	var purged int64
+	for _, name := range names {
+		start, err := time.Parse(partitionLayouts[p.Interval], strings.TrimPrefix(name, "raw_requests_p"))
+		if err != nil {
+			continue
+		}
+		// Requests can't have been done before they arrived, so newer partitions can be skipped.
+		if p.next(start).After(t) {
+			continue
+		}
+		var n int64
+		err = pd.retry(context.Background(), "purge", func(ctx context.Context) error {
+			var err error
+			n, err = dropIfDone(ctx, pd.Dbh, pd.Schema, name, t)
+			return err
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+
+	var n int64
+	err = pd.retry(context.Background(), "purge", func(ctx context.Context) error {
+		res, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			DELETE FROM %s.raw_requests_default WHERE done_at < $1
+		`, pq.QuoteIdentifier(pd.Schema)), t)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return purged, fmt.Errorf("pg.Purge (DELETE): %w", err)
+	}
+	return purged + n, ensureErr
+}
@@ -1,6 +1,7 @@
 package pg
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
@@ -15,9 +16,33 @@ import (
 type PgDumper struct {
 	Schema string
 	Dbh    *sql.DB
+	// DSN is the connection string for Dbh, needed by Notifications, which opens its own connection.
+	DSN string
+	// BatchSize limits how many requests MarkBatch puts in each batch. Zero means no limit.
+	// With a limit, several workers can share a backlog, each claiming its own batches.
+	BatchSize int
+	// Retain keeps requests after their batch is done, setting done_at instead of deleting them.
+	// They can then be deleted with Purge.
+	Retain bool
+	// Partitioning, if set, is how the table was created by SchemaInitPartitioned.
+	// Processed requests are always kept, as if Retain was set, and Purge drops whole partitions.
+	Partitioning *Partitioning
+	// Retry, if set, retries operations that fail with a transient error, as judged by Retryable.
+	// A write whose result was lost with the connection may be retried after it succeeded,
+	// so requests are stored at least once.
+	Retry *RetryPolicy
+	// Notify announces stored requests with a NOTIFY on the channel named after Schema, for Notifications.
+	// It's off by default: NOTIFY takes a database-wide lock while committing, so concurrent writes queue up.
+	Notify bool
 }
 
 func SchemaInit(dbh *sql.DB, schema string) error {
+	return schemaInit(dbh, schema, nil)
+}
+
+// schemaInit creates the schema and raw_requests table, partitioned if p is set, and adds
+// columns that older tables are missing.
+func schemaInit(dbh *sql.DB, schema string, p *Partitioning) error {
 	if schema == "" {
 		schema = "request_dump"
 	}
@@ -34,7 +59,7 @@ func SchemaInit(dbh *sql.DB, schema string) error {
 		log.Printf("pg.SchemaInit: creating schema [%s]\n", schema)
 		_, err := dbh.Exec(fmt.Sprintf("CREATE SCHEMA %s", pq.QuoteIdentifier(schema)))
 		if err != nil {
-			return fmt.Errorf("pg.SchemaInit: %s", err)
+			return fmt.Errorf("pg.SchemaInit: %w", err)
 		}
 	}
 
@@ -43,7 +68,12 @@ func SchemaInit(dbh *sql.DB, schema string) error {
 	if err != nil {
 		return err
 	}
-	if exists == false {
+	if exists == false && p != nil {
+		log.Printf("pg.SchemaInit: creating table [%s.%s], partitioned by %s\n", schema, table, p.Interval)
+		if err = createPartitioned(dbh, schema); err != nil {
+			return err
+		}
+	} else if exists == false {
 		log.Printf("pg.SchemaInit: creating table [%s.%s]\n", schema, table)
 		ddls := []string{
 			fmt.Sprintf(`
@@ -61,98 +91,375 @@ func SchemaInit(dbh *sql.DB, schema string) error {
 		for _, ddl := range ddls {
 			_, err := dbh.Exec(ddl)
 			if err != nil {
-				return fmt.Errorf("pg.SchemaInit: %s", err)
+				return fmt.Errorf("pg.SchemaInit: %w", err)
 			}
 		}
 	}
 
+	if exists && p != nil {
+		partitioned, err := isPartitioned(dbh, schema)
+		if err != nil {
+			return err
+		} else if !partitioned {
+			return fmt.Errorf("pg.SchemaInit: table [%s.%s] exists, and isn't partitioned", schema, table)
+		}
+	}
+
+	// Columns added after the table was first created.
+	ddls := []string{
+		fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS done_at timestamptz",
+			pq.QuoteIdentifier(schema), table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS raw_requests_done_at_idx ON %s.%s (done_at)",
+			pq.QuoteIdentifier(schema), table),
+	}
+	for _, ddl := range ddls {
+		_, err := dbh.Exec(ddl)
+		if err != nil {
+			return fmt.Errorf("pg.SchemaInit: %w", err)
+		}
+	}
+
 	return nil
 }
 
 func (pd *PgDumper) Dump(req *storage.Request) error {
-	_, err := pd.Dbh.Exec(fmt.Sprintf(`
-		INSERT INTO %s.raw_requests (head, data, "when")
-		VALUES ($1, $2, $3)
-	`, pd.Schema), string(req.Head), string(req.Data), req.When.Format(time.RFC3339))
+	return pd.DumpContext(context.Background(), req)
+}
+
+// DumpContext is Dump, giving up on retries once ctx is done.
+func (pd *PgDumper) DumpContext(ctx context.Context, req *storage.Request) error {
+	defer storage.TimeBackend("pg", "dump")()
+	err := pd.retry(ctx, "dump", func(ctx context.Context) error {
+		if !pd.Notify {
+			_, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+				INSERT INTO %s.raw_requests (head, data, "when")
+				VALUES ($1, $2, $3)
+			`, pd.Schema), string(req.Head), string(req.Data), req.When.Format(time.RFC3339))
+			return err
+		}
+		// Announce the new request to any listeners in the same statement, so it costs no extra round trip.
+		_, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			WITH ins AS (
+				INSERT INTO %s.raw_requests (head, data, "when")
+				VALUES ($1, $2, $3)
+			)
+			SELECT pg_notify($4, '')
+		`, pd.Schema), string(req.Head), string(req.Data), req.When.Format(time.RFC3339), pd.Schema)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("pg.Dump (INSERT): %s", err)
+		return fmt.Errorf("pg.Dump (INSERT): %w", err)
 	}
 	return nil
 }
 
-func (pd *PgDumper) MarkBatch() (int64, error) {
-	var maxID sql.NullInt64
-	row := pd.Dbh.QueryRow(fmt.Sprintf(`
-		SELECT max(request_id) FROM %s.raw_requests
-		 WHERE (batch_id = 0 OR batch_id IS NULL)
-	`, pd.Schema))
-	err := row.Scan(&maxID)
+// DumpMany stores several requests in one transaction, with COPY FROM STDIN, which is much
+// faster than an INSERT for each request. storage/groupcommit uses it to write queued requests.
+func (pd *PgDumper) DumpMany(reqs []*storage.Request) error {
+	defer storage.TimeBackend("pg", "dump_many")()
+	return pd.retry(context.Background(), "dump_many", func(ctx context.Context) error {
+		return pd.dumpMany(ctx, reqs)
+	})
+}
+
+// dumpMany runs the transaction for DumpMany once.
+func (pd *PgDumper) dumpMany(ctx context.Context, reqs []*storage.Request) error {
+	tx, err := pd.Dbh.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("pg.MarkBatch (SELECT): %s", err)
+		return fmt.Errorf("pg.DumpMany (BEGIN): %w", err)
 	}
-	if maxID.Valid == false {
-		return 0, nil
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(pd.Schema, "raw_requests", "head", "data", "when"))
+	if err != nil {
+		return fmt.Errorf("pg.DumpMany (COPY): %w", err)
+	}
+	for _, req := range reqs {
+		_, err = stmt.ExecContext(ctx, string(req.Head), string(req.Data), req.When.Format(time.RFC3339))
+		if err != nil {
+			stmt.Close()
+			return fmt.Errorf("pg.DumpMany (COPY): %w", err)
+		}
+	}
+	// Executing with no arguments flushes the buffered rows.
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("pg.DumpMany (COPY): %w", err)
+	}
+	if err = stmt.Close(); err != nil {
+		return fmt.Errorf("pg.DumpMany (COPY): %w", err)
+	}
+	// Listeners are notified when the transaction commits.
+	if pd.Notify {
+		if _, err = tx.ExecContext(ctx, `SELECT pg_notify($1, '')`, pd.Schema); err != nil {
+			return fmt.Errorf("pg.DumpMany (NOTIFY): %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("pg.DumpMany (COMMIT): %w", err)
+	}
+	return nil
+}
+
+// MarkBatch claims pending requests as a new batch, and returns its ID, which is taken from the
+// request ID sequence before claiming. Rows are claimed with FOR UPDATE SKIP LOCKED in a single statement,
+// so several processes can call MarkBatch on the same table at once, and each gets a disjoint batch.
+// Since the ID is chosen first, a retry after a claim's result was lost finds the rows it claimed,
+// instead of leaving them in a batch nobody processes.
+func (pd *PgDumper) MarkBatch() (int64, error) {
+	defer storage.TimeBackend("pg", "mark_batch")()
+	var limit sql.NullInt64
+	if pd.BatchSize > 0 {
+		limit = sql.NullInt64{Int64: int64(pd.BatchSize), Valid: true}
 	}
 
-	res, err := pd.Dbh.Exec(fmt.Sprintf(`
-		UPDATE %s.raw_requests SET batch_id = $1
-		 WHERE (batch_id = 0 OR batch_id IS NULL)
-		   AND request_id <= $1`, pd.Schema), maxID.Int64)
+	var batchID int64
+	err := pd.retry(context.Background(), "mark_batch", func(ctx context.Context) error {
+		row := pd.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT nextval(pg_get_serial_sequence('%s.raw_requests', 'request_id'))
+		`, pd.Schema))
+		return row.Scan(&batchID)
+	})
 	if err != nil {
-		return 0, fmt.Errorf("pg.MarkBatch (UPDATE): %s", err)
+		return 0, fmt.Errorf("pg.MarkBatch (SELECT): %w", err)
 	}
-	n, err := res.RowsAffected()
+
+	var n int64
+	err = pd.retry(context.Background(), "mark_batch", func(ctx context.Context) error {
+		row := pd.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			WITH prior AS (
+				SELECT 1 FROM %[1]s.raw_requests WHERE batch_id = $2 LIMIT 1
+			), claimed AS (
+				SELECT request_id FROM %[1]s.raw_requests
+				 WHERE (batch_id = 0 OR batch_id IS NULL)
+				   AND NOT EXISTS (SELECT 1 FROM prior)
+				 ORDER BY request_id ASC
+				 LIMIT $1
+				   FOR UPDATE SKIP LOCKED
+			), updated AS (
+				UPDATE %[1]s.raw_requests r SET batch_id = $2
+				  FROM claimed
+				 WHERE r.request_id = claimed.request_id
+				RETURNING 1
+			)
+			SELECT (SELECT count(*) FROM updated) + (SELECT count(*) FROM prior)
+		`, pd.Schema), limit, batchID)
+		return row.Scan(&n)
+	})
 	if err != nil {
-		return 0, err
-	} else if n <= 0 {
+		return 0, fmt.Errorf("pg.MarkBatch (UPDATE): %w", err)
+	}
+	if n <= 0 {
 		return 0, nil
 	}
 
-	return maxID.Int64, nil
+	return batchID, nil
 }
 
 func (pd *PgDumper) ReadRequests(batchID int64) ([]storage.Request, error) {
+	defer storage.TimeBackend("pg", "read_requests")()
+	var reqs []storage.Request
+	err := pd.retry(context.Background(), "read_requests", func(ctx context.Context) error {
+		var err error
+		reqs, err = pd.readRequests(ctx, batchID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// readRequests runs the query for ReadRequests once.
+func (pd *PgDumper) readRequests(ctx context.Context, batchID int64) ([]storage.Request, error) {
 	reqs := make([]storage.Request, 0, 32)
 	n := 0
 
-	rows, err := pd.Dbh.Query(fmt.Sprintf(`
+	rows, err := pd.Dbh.QueryContext(ctx, fmt.Sprintf(`
 		SELECT request_id, head, data, "when"
 		  FROM %s.raw_requests
 		 WHERE batch_id = $1
-		 ORDER BY "when" ASC
+		 ORDER BY "when" ASC, request_id ASC
 	`, pd.Schema), batchID)
 	if err != nil {
-		return nil, fmt.Errorf("pg.ReadRequests (SELECT): %s", err)
+		return nil, fmt.Errorf("pg.ReadRequests (SELECT): %w", err)
 	}
 	defer rows.Close()
 
-	var tmpID int64
 	for rows.Next() {
 		if rows.Err() == io.EOF {
 			break
 		}
+		var tmpID int64
 		req := &storage.Request{}
 		err = rows.Scan(&tmpID, &req.Head, &req.Data, &req.When)
 		if err != nil {
-			return nil, fmt.Errorf("pg.ReadRequests (Scan): %s", err)
+			return nil, fmt.Errorf("pg.ReadRequests (Scan): %w", err)
 		}
 		req.ID = &tmpID
 		reqs = append(reqs, *req)
 		n++
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("pg.ReadRequests (Err): %s", err)
+		return nil, fmt.Errorf("pg.ReadRequests (Err): %w", err)
 	}
 
 	return reqs, nil
 }
 
 func (pd *PgDumper) BatchDone(batchID int64) error {
-	_, err := pd.Dbh.Exec(fmt.Sprintf(`
-		DELETE FROM %s.raw_requests WHERE batch_id = $1
-	`, pd.Schema), batchID)
+	defer storage.TimeBackend("pg", "batch_done")()
+	if pd.Retain || pd.Partitioning != nil {
+		err := pd.retry(context.Background(), "batch_done", func(ctx context.Context) error {
+			_, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+				UPDATE %s.raw_requests SET done_at = now()
+				 WHERE batch_id = $1 AND done_at IS NULL
+			`, pd.Schema), batchID)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("pg.BatchDone (UPDATE): %w", err)
+		}
+		return nil
+	}
+
+	err := pd.retry(context.Background(), "batch_done", func(ctx context.Context) error {
+		_, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			DELETE FROM %s.raw_requests WHERE batch_id = $1
+		`, pd.Schema), batchID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("pg.BatchDone (DELETE): %w", err)
+	}
+	return nil
+}
+
+// Rebatch moves the given requests into a new batch, clearing done_at, so they can be processed again.
+// The batch ID is taken from the request ID sequence, so it won't collide with batches from MarkBatch.
+func (pd *PgDumper) Rebatch(ids []int64) (int64, error) {
+	defer storage.TimeBackend("pg", "rebatch")()
+	var batchID int64
+	err := pd.retry(context.Background(), "rebatch", func(ctx context.Context) error {
+		row := pd.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT nextval(pg_get_serial_sequence('%s.raw_requests', 'request_id'))
+		`, pd.Schema))
+		if err := row.Scan(&batchID); err != nil {
+			return fmt.Errorf("pg.Rebatch (SELECT): %w", err)
+		}
+
+		_, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE %s.raw_requests SET batch_id = $1, done_at = NULL
+			 WHERE request_id = ANY($2)
+		`, pd.Schema), batchID, pq.Array(ids))
+		if err != nil {
+			return fmt.Errorf("pg.Rebatch (UPDATE): %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return batchID, nil
+}
+
+// Backlog reports how many requests haven't been processed yet, and when the oldest one arrived.
+func (pd *PgDumper) Backlog() (int64, time.Time, error) {
+	defer storage.TimeBackend("pg", "backlog")()
+	var pending int64
+	var oldest pq.NullTime
+	err := pd.retry(context.Background(), "backlog", func(ctx context.Context) error {
+		row := pd.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT count(*), min("when") FROM %s.raw_requests
+			 WHERE done_at IS NULL
+		`, pd.Schema))
+		return row.Scan(&pending, &oldest)
+	})
 	if err != nil {
-		return fmt.Errorf("pg.BatchDone (DELETE): %s", err)
+		return 0, time.Time{}, fmt.Errorf("pg.Backlog (SELECT): %w", err)
+	}
+	return pending, oldest.Time, nil
+}
+
+// Purge deletes requests whose batch was marked done before t, when Retain is set.
+// With Partitioning, it also creates upcoming partitions, and drops old ones instead of deleting rows.
+func (pd *PgDumper) Purge(t time.Time) (int64, error) {
+	defer storage.TimeBackend("pg", "purge")()
+	if pd.Partitioning != nil {
+		return pd.purgePartitions(t)
+	}
+	var purged int64
+	err := pd.retry(context.Background(), "purge", func(ctx context.Context) error {
+		res, err := pd.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			DELETE FROM %s.raw_requests WHERE done_at < $1
+		`, pd.Schema), t)
+		if err != nil {
+			return err
+		}
+		purged, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("pg.Purge (DELETE): %w", err)
+	}
+	return purged, nil
+}
+
+// Notifications listens on the channel named after Schema, which Dump and DumpMany notify when Notify is set,
+// and sends on the returned channel when requests are stored. Notifications are coalesced,
+// and one is also sent after reconnecting, since some may have been missed.
+// The channel is closed once ctx is done.
+func (pd *PgDumper) Notifications(ctx context.Context) (<-chan struct{}, error) {
+	if !pd.Notify {
+		return nil, fmt.Errorf("pg.Notifications: Notify isn't set")
+	} else if pd.DSN == "" {
+		return nil, fmt.Errorf("pg.Notifications: DSN isn't set")
+	}
+	l := pq.NewListener(pd.DSN, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("pg.Notifications: %s\n", err)
+		}
+	})
+	if err := l.Listen(pd.Schema); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("pg.Notifications (LISTEN): %w", err)
+	}
+
+	wake := make(chan struct{}, 1)
+	go func() {
+		defer close(wake)
+		defer l.Close()
+		// Check the connection now and then, since a dead one might not be noticed otherwise.
+		ping := time.NewTicker(90 * time.Second)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-l.Notify:
+				// A nil notification means the connection was re-established.
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case <-ping.C:
+				go l.Ping()
+			}
+		}
+	}()
+	return wake, nil
+}
+
+// Ping checks that the database is reachable.
+func (pd *PgDumper) Ping() error {
+	if err := pd.Dbh.Ping(); err != nil {
+		return fmt.Errorf("pg.Ping: %w", err)
 	}
 	return nil
 }
+
+// Close closes the database handle.
+func (pd *PgDumper) Close() error {
+	return pd.Dbh.Close()
+}
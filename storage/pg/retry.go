@@ -0,0 +1,125 @@
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/lib/pq"
+)
+
+// RetryPolicy controls how PgDumper retries operations that fail with transient errors,
+// such as while a server restarts or fails over.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxElapsed bounds the time spent on an operation, including retries,
+	// when the caller's context doesn't have a deadline of its own.
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy rides out a failover of several seconds.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    6,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     3 * time.Second,
+	MaxElapsed:     15 * time.Second,
+}
+
+// retryableCodes are SQLSTATEs, outside of the retryable classes, that are worth retrying.
+var retryableCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"25006": true, // read_only_sql_transaction, from a server that was just demoted
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// retryableClasses are SQLSTATE classes whose errors are expected to go away on their own.
+var retryableClasses = map[pq.ErrorClass]bool{
+	"08": true, // connection_exception
+	"53": true, // insufficient_resources, such as too_many_connections
+}
+
+// Retryable reports whether err is likely to be transient, so the operation that returned it
+// may succeed if it's tried again: lost or refused connections, and server errors whose
+// SQLSTATE says so. Anything else, including errors in the statement itself, is fatal.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if pqErr.Code == "53100" { // disk_full won't clear up in time for a retry
+			return false
+		}
+		return retryableCodes[pqErr.Code] || retryableClasses[pqErr.Code.Class()]
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backoff returns how long to wait before the given retry (starting from 1), doubling
+// from InitialBackoff up to MaxBackoff, with jitter so clients don't retry in lockstep.
+func (rp *RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.InitialBackoff
+	for i := 1; i < retry && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry calls fn until it succeeds, returns an error that isn't Retryable, or the policy
+// or ctx runs out, and returns its last error. fn should use the context it's given.
+// Without a Retry policy, fn is called once.
+func (pd *PgDumper) retry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	rp := pd.Retry
+	if rp == nil {
+		return fn(ctx)
+	}
+	if _, ok := ctx.Deadline(); !ok && rp.MaxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rp.MaxElapsed)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if !Retryable(err) {
+			return err
+		}
+		wait := rp.backoff(attempt)
+		deadline, ok := ctx.Deadline()
+		if attempt >= rp.MaxAttempts || (ok && time.Until(deadline) < wait) {
+			storage.BackendRetriesExhausted.WithLabelValues("pg", op).Inc()
+			return err
+		}
+
+		storage.BackendRetries.WithLabelValues("pg", op).Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			storage.BackendRetriesExhausted.WithLabelValues("pg", op).Inc()
+			return err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection_exception class", &pq.Error{Code: "08006"}, true},
+		{"connection_does_not_exist", &pq.Error{Code: "08003"}, true},
+		{"too_many_connections", &pq.Error{Code: "53300"}, true},
+		{"out_of_memory", &pq.Error{Code: "53200"}, true},
+		{"disk_full", &pq.Error{Code: "53100"}, false},
+		{"serialization_failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock_detected", &pq.Error{Code: "40P01"}, true},
+		{"read_only_sql_transaction", &pq.Error{Code: "25006"}, true},
+		{"admin_shutdown", &pq.Error{Code: "57P01"}, true},
+		{"crash_shutdown", &pq.Error{Code: "57P02"}, true},
+		{"cannot_connect_now", &pq.Error{Code: "57P03"}, true},
+		{"query_canceled", &pq.Error{Code: "57014"}, false},
+		{"unique_violation", &pq.Error{Code: "23505"}, false},
+		{"syntax_error", &pq.Error{Code: "42601"}, false},
+		{"wrapped", fmt.Errorf("pg.Dump: %w", &pq.Error{Code: "40P01"}), true},
+		{"bad connection", driver.ErrBadConn, true},
+		{"EOF", io.EOF, true},
+		{"unexpected EOF", fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{"network", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"canceled", context.Canceled, false},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), false},
+		{"other", errors.New("something else"), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Retryable(c.err); got != c.want {
+				t.Errorf("Retryable(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+// attempts calls pd.retry with fn, which fails with err every time, and returns how many
+// times fn was called, how long it took, and the error retry returned.
+func attempts(pd *PgDumper, ctx context.Context, err error) (int, time.Duration, error) {
+	n := 0
+	start := time.Now()
+	rerr := pd.retry(ctx, "test", func(ctx context.Context) error {
+		n++
+		return err
+	})
+	return n, time.Since(start), rerr
+}
+
+func TestRetry(t *testing.T) {
+	transient := &pq.Error{Code: "57P03"}
+	fast := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	t.Run("MaxAttempts", func(t *testing.T) {
+		n, _, err := attempts(&PgDumper{Retry: &fast}, context.Background(), transient)
+		if n != 4 || err != transient {
+			t.Fatalf("%d attempts, error %v; want 4, %v", n, err, transient)
+		}
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		fatal := &pq.Error{Code: "23505"}
+		n, _, err := attempts(&PgDumper{Retry: &fast}, context.Background(), fatal)
+		if n != 1 || err != fatal {
+			t.Fatalf("%d attempts, error %v; want 1, %v", n, err, fatal)
+		}
+	})
+
+	t.Run("no policy", func(t *testing.T) {
+		n, _, err := attempts(&PgDumper{}, context.Background(), transient)
+		if n != 1 || err != transient {
+			t.Fatalf("%d attempts, error %v; want 1, %v", n, err, transient)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		n := 0
+		err := (&PgDumper{Retry: &fast}).retry(context.Background(), "test", func(ctx context.Context) error {
+			if n++; n < 3 {
+				return transient
+			}
+			return nil
+		})
+		if n != 3 || err != nil {
+			t.Fatalf("%d attempts, error %v; want 3, nil", n, err)
+		}
+	})
+
+	slow := RetryPolicy{
+		MaxAttempts:    1000,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		MaxElapsed:     100 * time.Millisecond,
+	}
+
+	t.Run("MaxElapsed", func(t *testing.T) {
+		n, elapsed, err := attempts(&PgDumper{Retry: &slow}, context.Background(), transient)
+		if err != transient {
+			t.Fatalf("error %v, want %v", err, transient)
+		}
+		if n < 2 || n >= 1000 || elapsed > 2*time.Second {
+			t.Fatalf("%d attempts in %s, want retries bounded by MaxElapsed", n, elapsed)
+		}
+	})
+
+	t.Run("ctx deadline", func(t *testing.T) {
+		rp := slow
+		rp.MaxElapsed = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		n, elapsed, err := attempts(&PgDumper{Retry: &rp}, ctx, transient)
+		if err != transient {
+			t.Fatalf("error %v, want %v", err, transient)
+		}
+		if n < 2 || n >= 1000 || elapsed > 2*time.Second {
+			t.Fatalf("%d attempts in %s, want retries bounded by the deadline", n, elapsed)
+		}
+	})
+
+	t.Run("ctx canceled", func(t *testing.T) {
+		rp := slow
+		rp.InitialBackoff, rp.MaxBackoff = time.Hour, time.Hour
+		rp.MaxElapsed = 0
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		n, elapsed, err := attempts(&PgDumper{Retry: &rp}, ctx, transient)
+		if n != 1 || err != transient || elapsed > 2*time.Second {
+			t.Fatalf("%d attempts in %s, error %v; want 1 attempt, stopped by cancel", n, elapsed, err)
+		}
+	})
+
+	t.Run("MaxElapsed sets a deadline", func(t *testing.T) {
+		var deadline bool
+		(&PgDumper{Retry: &slow}).retry(context.Background(), "test", func(ctx context.Context) error {
+			_, deadline = ctx.Deadline()
+			return nil
+		})
+		if !deadline {
+			t.Fatal("fn's context has no deadline")
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rebatcher is implemented by backends that can put requests that were already
+// processed through a batch again, usually because they're being kept by a retention mode.
+type Rebatcher interface {
+	// Rebatch moves the requests with the given IDs, whatever their state, into a new batch,
+	// and returns its ID. The new batch ID doesn't collide with any other batch.
+	Rebatch(ids []int64) (int64, error)
+}
+
+// rebatched is a Batcher whose next batch has already been marked, by Rebatch.
+type rebatched struct {
+	Batcher
+	batchID int64
+}
+
+func (r rebatched) MarkBatch() (int64, error) {
+	return r.batchID, nil
+}
+
+// Reprocess runs stored requests matching f through p again, in new batches of up to
+// batchSize requests. If pathPrefix is set, only requests whose path starts with it are included.
+// db must implement Inspector and Rebatcher. It returns how many requests were processed,
+// and stops at the first error, leaving the failed batch open to be retried or requeued.
+func Reprocess(db DumpBatcher, f Filter, pathPrefix string, batchSize int, p Processor) (int, error) {
+	i, ok := db.(Inspector)
+	if !ok {
+		return 0, fmt.Errorf("storage.Reprocess: %T can't list stored requests", db)
+	}
+	rb, ok := db.(Rebatcher)
+	if !ok {
+		return 0, fmt.Errorf("storage.Reprocess: %T can't rebatch stored requests", db)
+	}
+
+	total := 0
+	for {
+		reqs, err := i.ListRequests(f, 0, batchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(reqs) == 0 {
+			return total, nil
+		}
+		f.MinID = *reqs[len(reqs)-1].ID + 1
+
+		ids := make([]int64, 0, len(reqs))
+		for j := range reqs {
+			if pathPrefix == "" || strings.HasPrefix(requestPath(&reqs[j]), pathPrefix) {
+				ids = append(ids, *reqs[j].ID)
+			}
+		}
+		if len(ids) > 0 {
+			batchID, err := rb.Rebatch(ids)
+			if err != nil {
+				return total, err
+			}
+			n, err := ProcessBatch(rebatched{db, batchID}, p)
+			total += n
+			if err != nil {
+				return total, fmt.Errorf("storage.Reprocess (batch %d): %s", batchID, err)
+			}
+		}
+
+		if len(reqs) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// requestPath returns the path of a stored request, or "" if its head can't be parsed.
+func requestPath(req *Request) string {
+	r, err := req.HTTPRequest()
+	if err != nil {
+		return ""
+	}
+	return r.URL.Path
+}
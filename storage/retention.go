@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Sweep purges requests from p whose batch was marked done more than age ago,
+// once right away and then every interval, until ctx is done.
+func Sweep(ctx context.Context, p Purger, age, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Some requests may have been purged before an error.
+		n, err := p.Purge(time.Now().Add(-age))
+		if err != nil {
+			log.Printf("storage.Sweep: %s\n", err)
+		}
+		if n > 0 {
+			RequestsPurged.Add(float64(n))
+			log.Printf("storage.Sweep: purged %d requests processed more than %s ago\n", n, age)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+func TestZeroOptionsRetryBusy(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDumperOptions("requests.db", dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.busyTimeout != DefaultOptions.BusyTimeout || d.Retry != DefaultOptions.Retry {
+		t.Fatalf("busy timeout %s, retry %+v, want DefaultOptions", d.busyTimeout, d.Retry)
+	}
+
+	// Another connection holds the write lock for a while.
+	other, err := sql.Open("sqlite3", filepath.Join(dir, "requests.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(context.Background(), `BEGIN IMMEDIATE`); err != nil {
+		t.Fatal(err)
+	}
+	released := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, err := conn.ExecContext(context.Background(), `ROLLBACK`)
+		released <- err
+	}()
+
+	err = d.Dump(&storage.Request{Head: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), When: time.Now()})
+	if err != nil {
+		t.Fatalf("Dump while another connection held the lock: %v", err)
+	}
+	if err = <-released; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,28 @@
+package sqlite3
+
+import (
+	"testing"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.DumpBatcher {
+		d, err := NewDumper("hour", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestConformanceSingleFile(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.DumpBatcher {
+		d, err := NewDumper("requests.db", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+
+package sqlite3
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockName is the lock file every process using a rotated database directory holds.
+const lockName = ".httpdump.lock"
+
+// dirLock is a shared lock on a database directory. Each process using the directory holds it,
+// so a process can tell whether it's alone there before touching batches another one may have marked.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir takes a shared lock on dir, waiting for anyone holding it exclusively.
+func lockDir(dir string) (*dirLock, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &dirLock{file: file}, nil
+}
+
+// alone calls fn, and returns true, if no other process holds the directory. The lock is held
+// exclusively while fn runs, so no other process can start using the directory meanwhile.
+func (dl *dirLock) alone(fn func() error) (bool, error) {
+	fd := int(dl.file.Fd())
+	err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		// A conversion that fails may have dropped the shared lock, so take it again.
+		return false, syscall.Flock(fd, syscall.LOCK_SH)
+	} else if err != nil {
+		return false, err
+	}
+	err = fn()
+	if lerr := syscall.Flock(fd, syscall.LOCK_SH); err == nil {
+		err = lerr
+	}
+	return true, err
+}
+
+func (dl *dirLock) Close() error {
+	return dl.file.Close()
+}
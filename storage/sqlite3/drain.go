@@ -0,0 +1,377 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotating reports whether requests are stored in files rotated over time, rather than
+// in memory or in a single file.
+func (sqld *SQLiteDumper) rotating() bool {
+	return sqld.rotation != nil
+}
+
+// rotatedFiles returns the rotated database files in dbPath, other than skip, oldest first.
+// Files that have been fully processed, and renamed by finishFile, aren't included.
+func (sqld *SQLiteDumper) rotatedFiles(skip string) ([]string, error) {
+	return sqld.listFiles(skip, false)
+}
+
+// historyFiles is like rotatedFiles, but includes files renamed by finishFile, whose requests are kept with Retain.
+func (sqld *SQLiteDumper) historyFiles(skip string) ([]string, error) {
+	return sqld.listFiles(skip, true)
+}
+
+// isDone reports whether path was renamed by finishFile.
+func isDone(path string) bool {
+	return strings.HasSuffix(path, ".done.db")
+}
+
+func (sqld *SQLiteDumper) listFiles(skip string, done bool) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(sqld.dbPath, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	type rotated struct {
+		path string
+		when time.Time
+	}
+	files := make([]rotated, 0, len(paths))
+	for _, path := range paths {
+		if path == skip {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".db")
+		if isDone(path) {
+			if !done {
+				continue
+			}
+			name = strings.TrimSuffix(name, ".done")
+		}
+		when, ok := sqld.rotation.Started(name)
+		if !ok {
+			continue
+		}
+		files = append(files, rotated{path, when})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].when.Equal(files[j].when) {
+			return files[i].path < files[j].path
+		}
+		return files[i].when.Before(files[j].when)
+	})
+
+	sorted := make([]string, len(files))
+	for i, f := range files {
+		sorted[i] = f.path
+	}
+	return sorted, nil
+}
+
+// seedSequence starts dbh's request IDs after the newest other rotated file's, finished or not,
+// so request IDs, and batch IDs, which are request IDs, are never the same in two files.
+func (sqld *SQLiteDumper) seedSequence(dbh *sql.DB, dbfile string) error {
+	paths, err := sqld.historyFiles(dbfile)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	prev, err := sql.Open("sqlite3", sqld.fileDSN(paths[len(paths)-1]))
+	if err != nil {
+		return err
+	}
+	defer prev.Close()
+
+	var seq sql.NullInt64
+	err = prev.QueryRow(`SELECT max(seq) FROM sqlite_sequence WHERE name = 'raw_requests'`).Scan(&seq)
+	if err != nil || !seq.Valid {
+		// Nothing was ever stored in the previous file.
+		return nil
+	}
+	_, err = dbh.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('raw_requests', $1)`, seq.Int64)
+	return err
+}
+
+// oldDB returns a handle for the rotated file at path, opening it if necessary.
+// The caller must hold drainLock.
+func (sqld *SQLiteDumper) oldDB(path string) (*sql.DB, error) {
+	if dbh, ok := sqld.oldDBs[path]; ok {
+		return dbh, nil
+	}
+	dbh, err := sqld.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sqld.oldDBs[path] = dbh
+	return dbh, nil
+}
+
+// openFile opens the existing rotated file at path, bringing its schema up to date.
+// It fails, rather than create the file, if it's gone.
+func (sqld *SQLiteDumper) openFile(path string) (*sql.DB, error) {
+	dbh, err := sql.Open("sqlite3", sqld.existingDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	if err = dbh.Ping(); err != nil {
+		dbh.Close()
+		return nil, err
+	}
+	if err = migrate(dbh); err != nil {
+		dbh.Close()
+		return nil, err
+	}
+	return dbh, nil
+}
+
+// markOldBatch marks a batch in the oldest rotated file that still has pending requests,
+// and finishes with files that have been fully processed along the way. Files that can't be
+// read are logged and skipped, so they don't hold up newer requests. The read lock on the database
+// handle is held throughout, so the current file can't rotate and be mistaken for an old one.
+func (sqld *SQLiteDumper) markOldBatch() int64 {
+	defer sqld.rlock()()
+	paths, err := sqld.rotatedFiles(sqld.curFile)
+	if err != nil {
+		log.Printf("sqlite3.MarkBatch (Glob): %s\n", err)
+		return 0
+	}
+
+	sqld.drainLock.Lock()
+	defer sqld.drainLock.Unlock()
+	for _, path := range paths {
+		dbh, err := sqld.oldDB(path)
+		if err != nil {
+			log.Printf("sqlite3.MarkBatch (%s): %s\n", path, err)
+			continue
+		}
+		if !sqld.checked[path] {
+			requeued, err := sqld.requeueStranded(path, dbh)
+			if err != nil {
+				log.Printf("sqlite3.MarkBatch (%s): %s\n", path, err)
+				continue
+			}
+			// If another process is using the directory, try again next time.
+			sqld.checked[path] = requeued
+		}
+		batchID, err := markBatch(dbh, &sqld.Retry)
+		if err != nil {
+			log.Printf("sqlite3.MarkBatch (%s): %s\n", path, err)
+			continue
+		} else if batchID != 0 {
+			sqld.batchFiles[batchID] = []string{path}
+			return batchID
+		}
+		if err = sqld.finishFile(path, dbh); err != nil {
+			log.Printf("sqlite3.MarkBatch (%s): %s\n", path, err)
+		}
+	}
+	return 0
+}
+
+// requeueStranded makes requests in a rotated file pending again if their batch was marked but never
+// finished, by an earlier process, since nothing else would finish them, and the file would never be done.
+// Batches this process is still working on are left alone. Since only this process's batches are known,
+// nothing is requeued while another process (such as export -drain or reprocess) holds the directory;
+// it reports whether the file was checked. The caller must hold drainLock.
+func (sqld *SQLiteDumper) requeueStranded(path string, dbh *sql.DB) (bool, error) {
+	return sqld.dirLock.alone(func() error {
+		return sqld.requeueUnknown(path, dbh)
+	})
+}
+
+// requeueUnknown requeues batches in path that this process didn't mark. The caller must hold drainLock.
+func (sqld *SQLiteDumper) requeueUnknown(path string, dbh *sql.DB) error {
+	args := make([]interface{}, 0, 4)
+	marks := make([]string, 0, 4)
+	for batchID, paths := range sqld.batchFiles {
+		for _, p := range paths {
+			if p == path {
+				args = append(args, batchID)
+				marks = append(marks, fmt.Sprintf("$%d", len(args)))
+				break
+			}
+		}
+	}
+	query := `UPDATE raw_requests SET batch = NULL WHERE batch > 0 AND done IS NULL`
+	if len(marks) > 0 {
+		query += fmt.Sprintf(` AND batch NOT IN (%s)`, strings.Join(marks, ", "))
+	}
+	res, err := ExecRetry(context.Background(), dbh, &sqld.Retry, "requeue_stranded", query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Printf("sqlite3.MarkBatch: requeued %d requests left in unfinished batches in [%s]\n", n, path)
+	}
+	return nil
+}
+
+// finishFile closes a rotated file once every request in it has been processed. Without Retain,
+// the file is removed. With Retain, it's renamed to end in ".done.db", so it isn't checked again.
+// Files with batches that were marked but never finished are kept. The caller must hold drainLock.
+func (sqld *SQLiteDumper) finishFile(path string, dbh *sql.DB) error {
+	query := `SELECT count(*) FROM raw_requests`
+	if sqld.Retain {
+		query += ` WHERE done IS NULL`
+	}
+	var n int64
+	if err := dbh.QueryRow(query).Scan(&n); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	delete(sqld.oldDBs, path)
+	delete(sqld.checked, path)
+	if sqld.Retain {
+		// Move everything from the write-ahead log into the file itself before it's renamed.
+		if _, err := dbh.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			dbh.Close()
+			return err
+		}
+	}
+	if err := dbh.Close(); err != nil {
+		return err
+	}
+	if sqld.Retain {
+		done := strings.TrimSuffix(path, ".db") + ".done.db"
+		log.Printf("Finished with database [%s], renaming to [%s]\n", path, done)
+		if err := os.Rename(path, done); err != nil {
+			return err
+		}
+		// Another connection may have kept the log files around; they must follow the file.
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if err := os.Rename(path+suffix, done+suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	log.Printf("Finished with database [%s], removing it\n", path)
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchDBs returns the handles for the files batchID was marked or rebatched in, and a function
+// to call once they're no longer needed.
+func (sqld *SQLiteDumper) batchDBs(batchID int64) ([]*sql.DB, func(), error) {
+	unlock := sqld.rlock()
+	if !sqld.rotating() {
+		return []*sql.DB{sqld.dbh}, unlock, nil
+	}
+	sqld.drainLock.Lock()
+	defer sqld.drainLock.Unlock()
+	paths, ok := sqld.batchFiles[batchID]
+	if !ok {
+		return []*sql.DB{sqld.dbh}, unlock, nil
+	}
+
+	dbhs := make([]*sql.DB, 0, len(paths))
+	current := false
+	for _, path := range paths {
+		if path == sqld.curFile {
+			dbhs = append(dbhs, sqld.dbh)
+			current = true
+			continue
+		}
+		dbh, err := sqld.oldDB(path)
+		if err != nil {
+			unlock()
+			return nil, nil, fmt.Errorf("sqlite3: batch [%d] in [%s]: %s", batchID, path, err)
+		}
+		dbhs = append(dbhs, dbh)
+	}
+	if !current {
+		// Rotation doesn't need to wait for batches in older files.
+		unlock()
+		unlock = func() {}
+	}
+	return dbhs, unlock, nil
+}
+
+// eachFile calls fn with each rotated file, oldest first, and then with the current file, stopping
+// at the first error. Files already finished by finishFile are included, so requests kept with Retain
+// can be inspected, purged and rebatched; they're opened for the call only, not kept open like files
+// being drained. The caller must hold a read lock on the database handle. In rotated mode, fn is called
+// with drainLock held.
+func (sqld *SQLiteDumper) eachFile(fn func(path string, dbh *sql.DB) error) error {
+	if sqld.dbh == nil {
+		return fmt.Errorf("sqlite3: nil database handle")
+	}
+	if sqld.rotating() {
+		paths, err := sqld.historyFiles(sqld.curFile)
+		if err != nil {
+			return err
+		}
+		sqld.drainLock.Lock()
+		defer sqld.drainLock.Unlock()
+		for _, path := range paths {
+			if err = sqld.eachOldFile(path, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return fn(sqld.curFile, sqld.dbh)
+}
+
+// eachOldFile calls fn with the rotated file at path, for eachFile. The caller must hold drainLock.
+func (sqld *SQLiteDumper) eachOldFile(path string, fn func(path string, dbh *sql.DB) error) error {
+	if !isDone(path) {
+		dbh, err := sqld.oldDB(path)
+		if err != nil {
+			return fmt.Errorf("sqlite3: [%s]: %s", path, err)
+		}
+		return fn(path, dbh)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Expired since it was listed.
+		return nil
+	}
+	dbh, err := sqld.openFile(path)
+	if err != nil {
+		return fmt.Errorf("sqlite3: [%s]: %s", path, err)
+	}
+	err = fn(path, dbh)
+	if cerr := dbh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// reopenFile renames a file finished by finishFile back to its original name, once requests in it
+// have been rebatched, so it's drained again if the process stops before the batch is done.
+// It returns the new path. The caller must hold drainLock.
+func (sqld *SQLiteDumper) reopenFile(done string) (string, error) {
+	path := strings.TrimSuffix(done, ".done.db") + ".db"
+	log.Printf("Requests in [%s] were rebatched, renaming to [%s]\n", done, path)
+	if err := os.Rename(done, path); err != nil {
+		return "", err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Rename(done+suffix, path+suffix); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// forgetBatch stops tracking which file batchID was marked in, once it's done.
+func (sqld *SQLiteDumper) forgetBatch(batchID int64) {
+	if !sqld.rotating() {
+		return
+	}
+	sqld.drainLock.Lock()
+	delete(sqld.batchFiles, batchID)
+	sqld.drainLock.Unlock()
+}
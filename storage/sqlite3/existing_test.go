@@ -0,0 +1,78 @@
+package sqlite3
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+func TestOpenExisting(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenExisting("hour", dir, Options{}); err == nil {
+		t.Fatal("opened an empty directory")
+	}
+	if _, err := OpenExisting("requests.db", dir, Options{}); err == nil {
+		t.Fatal("opened a missing file")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("files created: %v", entries)
+	}
+
+	// A file from a few hours ago, which a writer would rotate away from.
+	old := time.Now().Add(-3 * time.Hour)
+	hour := TimeRotation{Layout: DateFormats["hour"]}
+	d, err := NewDumperOptions("", dir, Options{Rotation: stuckRotation{hour, old}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = d.Dump(&storage.Request{Head: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), When: old}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+
+	ro, err := OpenExisting("hour", dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	reqs, err := ro.ListRequests(storage.Filter{}, 0, 0)
+	if err != nil || len(reqs) != 2 {
+		t.Fatalf("listed %d requests (%v), want 2", len(reqs), err)
+	}
+	if n, _, err := ro.Backlog(); err != nil || n != 2 {
+		t.Fatalf("backlog %d (%v), want 2", n, err)
+	}
+	if err = ro.Dump(&storage.Request{Head: []byte("GET / HTTP/1.1\r\n\r\n"), When: time.Now()}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Dump: got %v, want %v", err, ErrReadOnly)
+	}
+	if _, err = ro.MarkBatch(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("MarkBatch: got %v, want %v", err, ErrReadOnly)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+	if len(after) != len(before) || after[0] != before[0] {
+		t.Fatalf("files %v after opening read-only, want %v", after, before)
+	}
+}
+
+// stuckRotation names every file as if it were started at when.
+type stuckRotation struct {
+	TimeRotation
+	when time.Time
+}
+
+func (sr stuckRotation) FileName(t time.Time) string {
+	return sr.TimeRotation.FileName(sr.when)
+}
+
+func (sr stuckRotation) Rotate(cur FileStat, now time.Time) bool {
+	return sr.FileName(now) != cur.Name
+}
@@ -0,0 +1,211 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// Dates are stored as text including a zone offset, so compare them as julian days.
+var filterColumns = storage.FilterColumns{ID: "id", When: "date", Batch: "batch", Done: "done", TimeCompare: "julianday(%s)"}
+
+// rlock takes a read lock on the database handle, if needed, and returns the matching unlock.
+// The in-memory db doesn't need a lock since it won't change after the first init.
+func (sqld *SQLiteDumper) rlock() func() {
+	if sqld.inMemory {
+		return func() {}
+	}
+	sqld.dbhRWLock.RLock()
+	return sqld.dbhRWLock.RUnlock
+}
+
+// scanRequests reads rows of (id, head, data, date, batch, done).
+func scanRequests(rows *sql.Rows) ([]storage.Request, error) {
+	reqs := make([]storage.Request, 0, 32)
+	for rows.Next() {
+		var id int64
+		var batch sql.NullInt64
+		var done sql.NullTime
+		req := storage.Request{}
+		err := rows.Scan(&id, &req.Head, &req.Data, &req.When, &batch, &done)
+		if err != nil {
+			return nil, err
+		}
+		req.ID = &id
+		if batch.Valid && batch.Int64 != 0 {
+			b := int(batch.Int64)
+			req.Batch = &b
+		}
+		if done.Valid {
+			req.Done = &done.Time
+		}
+		reqs = append(reqs, req)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// ListRequests lists matching requests in the current file and, in rotated mode, in older files,
+// including finished ones kept with Retain.
+func (sqld *SQLiteDumper) ListRequests(f storage.Filter, offset, limit int) ([]storage.Request, error) {
+	defer sqld.rlock()()
+	where, args := f.SQL(filterColumns, nil)
+	// Each file can contribute up to offset+limit requests; the page is cut from all of them.
+	fileLimit := -1
+	if limit > 0 {
+		fileLimit = offset + limit
+	}
+	args = append(args, fileLimit)
+	query := fmt.Sprintf(`
+		SELECT id, head, data, date, batch, done
+		  FROM raw_requests
+		 WHERE %s
+		 ORDER BY id ASC
+		 LIMIT $%d
+	`, where, len(args))
+
+	reqs := make([]storage.Request, 0, 32)
+	err := sqld.eachFile(func(path string, dbh *sql.DB) error {
+		rows, err := QueryRetry(context.Background(), dbh, &sqld.Retry, "list_requests", query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		found, err := scanRequests(rows)
+		reqs = append(reqs, found...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(reqs, func(i, j int) bool { return *reqs[i].ID < *reqs[j].ID })
+	if offset >= len(reqs) {
+		return reqs[:0], nil
+	}
+	reqs = reqs[offset:]
+	if limit > 0 && len(reqs) > limit {
+		reqs = reqs[:limit]
+	}
+	return reqs, nil
+}
+
+func (sqld *SQLiteDumper) GetRequest(id int64) (*storage.Request, error) {
+	defer sqld.rlock()()
+	var found []storage.Request
+	err := sqld.eachFile(func(path string, dbh *sql.DB) error {
+		if len(found) > 0 {
+			return nil
+		}
+		rows, err := QueryRetry(context.Background(), dbh, &sqld.Retry, "get_request", `
+			SELECT id, head, data, date, batch, done
+			  FROM raw_requests
+			 WHERE id = $1
+		`, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		found, err = scanRequests(rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return &found[0], nil
+}
+
+// Batches lists open batches in every file. A batch rebatched across files is listed once.
+func (sqld *SQLiteDumper) Batches() ([]storage.BatchStatus, error) {
+	defer sqld.rlock()()
+	byID := map[int64]*storage.BatchStatus{}
+	err := sqld.eachFile(func(path string, dbh *sql.DB) error {
+		rows, err := QueryRetry(context.Background(), dbh, &sqld.Retry, "batches", `
+			SELECT batch, count(*), min(date), max(date)
+			  FROM raw_requests
+			 WHERE batch > 0 AND done IS NULL
+			 GROUP BY batch
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			b := storage.BatchStatus{}
+			var oldest, newest string
+			if err = rows.Scan(&b.ID, &b.Requests, &oldest, &newest); err != nil {
+				return err
+			}
+			if b.Oldest, err = parseTimestamp(oldest); err != nil {
+				return err
+			}
+			if b.Newest, err = parseTimestamp(newest); err != nil {
+				return err
+			}
+			prev, ok := byID[b.ID]
+			if !ok {
+				byID[b.ID] = &b
+				continue
+			}
+			prev.Requests += b.Requests
+			if b.Oldest.Before(prev.Oldest) {
+				prev.Oldest = b.Oldest
+			}
+			if b.Newest.After(prev.Newest) {
+				prev.Newest = b.Newest
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batches := make([]storage.BatchStatus, 0, len(byID))
+	for _, b := range byID {
+		batches = append(batches, *b)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].ID < batches[j].ID })
+	return batches, nil
+}
+
+func (sqld *SQLiteDumper) RequeueBatch(batchID int64) (int64, error) {
+	defer sqld.rlock()()
+	return sqld.execEach("requeue_batch", `
+		UPDATE raw_requests SET batch = NULL
+		 WHERE batch = $1 AND done IS NULL
+	`, batchID)
+}
+
+func (sqld *SQLiteDumper) DeleteRequests(f storage.Filter) (int64, error) {
+	defer sqld.rlock()()
+	where, args := f.SQL(filterColumns, nil)
+	return sqld.execEach("delete_requests", fmt.Sprintf(`
+		DELETE FROM raw_requests WHERE %s
+	`, where), args...)
+}
+
+// execEach runs query in every file, and returns how many rows it affected in all of them.
+// The caller must hold a read lock on the database handle.
+func (sqld *SQLiteDumper) execEach(op, query string, args ...interface{}) (int64, error) {
+	var total int64
+	err := sqld.eachFile(func(path string, dbh *sql.DB) error {
+		res, err := ExecRetry(context.Background(), dbh, &sqld.Retry, op, query, args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		total += n
+		return err
+	})
+	return total, err
+}
@@ -0,0 +1,211 @@
+package sqlite3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOverBudget is returned by Dump while the database directory is over Maintenance.MaxBytes,
+// and processed files alone couldn't bring it back under. It clears once enough requests
+// have been processed, and their files removed.
+var ErrOverBudget = errors.New("sqlite3: database directory is over its disk budget")
+
+// Maintenance configures Maintain.
+type Maintenance struct {
+	// Retention is how long fully processed files, which end in ".done.db", are kept after
+	// they were last written to. Zero keeps them.
+	Retention time.Duration
+	// ArchiveDir, if set, is where expired files are moved instead of being deleted.
+	// It must be on the same filesystem as the database directory.
+	ArchiveDir string
+	// MaxBytes is a budget for the database directory. When it's exceeded, the oldest processed
+	// files are removed, regardless of Retention. If that's not enough, Dump fails with
+	// ErrOverBudget until it is. Zero means no budget.
+	MaxBytes int64
+}
+
+// dir returns the directory holding the database files.
+func (sqld *SQLiteDumper) dir() string {
+	if sqld.dbFile != "" {
+		return filepath.Dir(sqld.dbFile)
+	}
+	return sqld.dbPath
+}
+
+// overBudget reports whether Dump should refuse new requests.
+func (sqld *SQLiteDumper) overBudget() bool {
+	return atomic.LoadInt32(&sqld.budgetExceeded) != 0
+}
+
+// RunMaintenance calls Maintain every interval until ctx is done, logging any errors.
+func (sqld *SQLiteDumper) RunMaintenance(ctx context.Context, m Maintenance, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sqld.Maintain(m); err != nil {
+			log.Printf("%s\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Maintain expires processed files older than m.Retention, vacuums the active file,
+// and enforces m.MaxBytes. It does nothing for the in-memory database.
+func (sqld *SQLiteDumper) Maintain(m Maintenance) error {
+	if sqld.inMemory {
+		return nil
+	}
+
+	done, err := sqld.doneFiles()
+	if err != nil {
+		return fmt.Errorf("sqlite3.Maintain (ReadDir): %s", err)
+	}
+	if m.Retention > 0 {
+		for len(done) > 0 && time.Since(done[0].ModTime()) > m.Retention {
+			if err = sqld.expire(done[0].Name(), m.ArchiveDir); err != nil {
+				return fmt.Errorf("sqlite3.Maintain (expire): %s", err)
+			}
+			done = done[1:]
+		}
+	}
+
+	if err = sqld.vacuum(); err != nil {
+		return fmt.Errorf("sqlite3.Maintain (VACUUM): %s", err)
+	}
+
+	if m.MaxBytes <= 0 {
+		atomic.StoreInt32(&sqld.budgetExceeded, 0)
+		return nil
+	}
+	size, err := dirSize(sqld.dir())
+	if err != nil {
+		return fmt.Errorf("sqlite3.Maintain (ReadDir): %s", err)
+	}
+	for size > m.MaxBytes && len(done) > 0 {
+		log.Printf("Database directory [%s] is over budget (%d > %d bytes)\n", sqld.dir(), size, m.MaxBytes)
+		if err = sqld.expire(done[0].Name(), m.ArchiveDir); err != nil {
+			return fmt.Errorf("sqlite3.Maintain (expire): %s", err)
+		}
+		size -= done[0].Size()
+		done = done[1:]
+	}
+	if size > m.MaxBytes {
+		if atomic.SwapInt32(&sqld.budgetExceeded, 1) == 0 {
+			log.Printf("Database directory [%s] is over budget (%d > %d bytes), refusing new requests\n",
+				sqld.dir(), size, m.MaxBytes)
+		}
+	} else if atomic.SwapInt32(&sqld.budgetExceeded, 0) != 0 {
+		log.Printf("Database directory [%s] is back under budget, accepting new requests\n", sqld.dir())
+	}
+	return nil
+}
+
+// doneFiles returns the fully processed files in the database directory, least recently written first.
+func (sqld *SQLiteDumper) doneFiles() ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(sqld.dir())
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), ".done.db") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, fi)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	return files, nil
+}
+
+// expire moves a processed file to archiveDir, or removes it if archiveDir is empty, along with
+// any write-ahead log and shared memory files left next to it.
+// drainLock is held, so it isn't expired while eachFile has it open.
+func (sqld *SQLiteDumper) expire(name, archiveDir string) error {
+	sqld.drainLock.Lock()
+	defer sqld.drainLock.Unlock()
+	path := filepath.Join(sqld.dir(), name)
+	if archiveDir != "" {
+		log.Printf("Archiving database [%s] to [%s]\n", path, archiveDir)
+		if err := os.MkdirAll(archiveDir, 0755); err != nil {
+			return err
+		}
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			err := os.Rename(path+suffix, filepath.Join(archiveDir, name+suffix))
+			if err != nil && (suffix == "" || !os.IsNotExist(err)) {
+				return err
+			}
+		}
+		return nil
+	}
+	log.Printf("Removing database [%s]\n", path)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// vacuum returns free pages in the active file to the filesystem. Files created with
+// incremental auto-vacuum, as new files are, only need an incremental vacuum; older files
+// get a full VACUUM, which also switches them to incremental auto-vacuum.
+func (sqld *SQLiteDumper) vacuum() error {
+	defer sqld.rlock()()
+	if sqld.dbh == nil {
+		return nil
+	}
+	var mode int
+	if err := sqld.dbh.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return err
+	}
+	query := `VACUUM`
+	if mode == 2 {
+		query = `PRAGMA incremental_vacuum`
+	}
+	_, err := ExecRetry(context.Background(), sqld.dbh, &sqld.Retry, "vacuum", query)
+	return err
+}
+
+// dirSize returns the total size of the regular files in dir, not including subdirectories.
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
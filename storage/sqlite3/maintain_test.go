@@ -0,0 +1,49 @@
+package sqlite3
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpireCompanions(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		dir := t.TempDir()
+		d, err := NewDumperOptions("", dir, Options{Rotation: SizeRotation{MaxRows: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		name := "2020-01-01T00-00-00.000000000Z.done.db"
+		old := time.Now().Add(-time.Hour)
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			path := filepath.Join(dir, name+suffix)
+			if err = os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m := Maintenance{Retention: time.Minute}
+		if archive {
+			m.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+		}
+		if err = d.Maintain(m); err != nil {
+			t.Fatal(err)
+		}
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if _, err = os.Stat(filepath.Join(dir, name+suffix)); !os.IsNotExist(err) {
+				t.Errorf("archive %v: %s%s is still there (%v)", archive, name, suffix, err)
+			}
+			if !archive {
+				continue
+			}
+			if _, err = os.Stat(filepath.Join(m.ArchiveDir, name+suffix)); err != nil {
+				t.Errorf("%s%s wasn't archived: %v", name, suffix, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package sqlite3
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// processAll marks, reads and finishes batches until none are left, and returns how many requests it read.
+func processAll(t *testing.T, d *SQLiteDumper) int {
+	t.Helper()
+	n := 0
+	for {
+		batchID, err := d.MarkBatch()
+		if err != nil {
+			t.Fatal(err)
+		} else if batchID == 0 {
+			return n
+		}
+		reqs, err := d.ReadRequests(batchID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(reqs)
+		if err = d.BatchDone(batchID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetainedFiles(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDumperOptions("", dir, Options{Rotation: SizeRotation{MaxRows: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.Retain = true
+
+	for i := 0; i < 3; i++ {
+		err = d.Dump(&storage.Request{Head: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), When: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := processAll(t, d); n != 3 {
+		t.Fatalf("processed %d requests, want 3", n)
+	}
+	done, err := filepath.Glob(filepath.Join(dir, "*.done.db"))
+	if err != nil || len(done) != 1 {
+		t.Fatalf("finished files %v (%v), want 1", done, err)
+	}
+
+	reqs, err := d.ListRequests(storage.Filter{State: storage.StateDone}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(reqs) != 3 {
+		t.Fatalf("listed %d done requests, want 3", len(reqs))
+	}
+	if _, err = d.GetRequest(*reqs[0].ID); err != nil {
+		t.Fatalf("getting request %d from a finished file: %v", *reqs[0].ID, err)
+	}
+
+	ids := make([]int64, len(reqs))
+	for i, req := range reqs {
+		ids[i] = *req.ID
+	}
+	batchID, err := d.Rebatch(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if still, _ := filepath.Glob(filepath.Join(dir, "*.done.db")); len(still) != 0 {
+		t.Fatalf("rebatched file wasn't renamed back: %v", still)
+	}
+	again, err := d.ReadRequests(batchID)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(again) != 3 {
+		t.Fatalf("rebatch read %d requests, want 3", len(again))
+	}
+	if err = d.BatchDone(batchID); err != nil {
+		t.Fatal(err)
+	}
+	if n := processAll(t, d); n != 0 {
+		t.Fatalf("processed %d more requests, want 0", n)
+	}
+	if done, _ = filepath.Glob(filepath.Join(dir, "*.done.db")); len(done) != 1 {
+		t.Fatalf("finished files %v after reprocessing, want 1", done)
+	}
+
+	n, err := d.Purge(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("purged %d requests, want 3", n)
+	}
+}
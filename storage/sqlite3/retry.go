@@ -0,0 +1,117 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// RetryPolicy bounds how operations that fail because the database is busy or locked are retried.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy retries for a few seconds, on top of the busy timeout.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    8,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+// RetryError is returned when an operation still failed with a retryable error after
+// the RetryPolicy ran out of attempts, or its context was done first.
+type RetryError struct {
+	Op       string
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("sqlite3.%s: gave up after %d attempts: %s", e.Op, e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether err means the database was busy or locked by another connection,
+// so the operation may succeed if it's tried again.
+func Retryable(err error) bool {
+	var sqlErr sqlite3.Error
+	if !errors.As(err, &sqlErr) {
+		return false
+	}
+	return sqlErr.Code == sqlite3.ErrBusy || sqlErr.Code == sqlite3.ErrLocked
+}
+
+// backoff returns how long to wait before the given retry (starting from 1), doubling
+// from InitialBackoff up to MaxBackoff, with jitter so writers don't retry in lockstep.
+func (rp *RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.InitialBackoff
+	for i := 1; i < retry && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Do calls fn until it returns an error that isn't Retryable, and returns that error.
+// If fn is still failing once MaxAttempts are used up, or ctx is done, it returns a *RetryError.
+func (rp *RetryPolicy) Do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !Retryable(err) {
+			return err
+		}
+		if attempt >= rp.MaxAttempts {
+			storage.BackendRetriesExhausted.WithLabelValues("sqlite3", op).Inc()
+			return &RetryError{Op: op, Attempts: attempt, Err: err}
+		}
+
+		storage.BackendRetries.WithLabelValues("sqlite3", op).Inc()
+		timer := time.NewTimer(rp.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			storage.BackendRetriesExhausted.WithLabelValues("sqlite3", op).Inc()
+			return &RetryError{Op: op, Attempts: attempt, Err: err}
+		}
+	}
+}
+
+// QueryRetry runs a query, retrying it according to rp while the database is busy or locked.
+func QueryRetry(ctx context.Context, db *sql.DB, rp *RetryPolicy, op, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := rp.Do(ctx, op, func() error {
+		var err error
+		rows, err = db.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// ExecRetry runs a statement, retrying it according to rp while the database is busy or locked.
+func ExecRetry(ctx context.Context, db *sql.DB, rp *RetryPolicy, op, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := rp.Do(ctx, op, func() error {
+		var err error
+		res, err = db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
@@ -0,0 +1,99 @@
+package sqlite3
+
+import (
+	"os"
+	"time"
+)
+
+// RotationPolicy decides when a rotating SQLiteDumper starts a new database file, and what it's named.
+type RotationPolicy interface {
+	// FileName returns the name, without ".db", of a file started at t.
+	FileName(t time.Time) string
+	// Started returns when a file named by FileName was started, or false if name isn't one of its.
+	// Older files are drained in this order.
+	Started(name string) (time.Time, bool)
+	// Rotate reports whether to start a new file at now, instead of writing to cur.
+	Rotate(cur FileStat, now time.Time) bool
+}
+
+// FileStat describes the database file being written to.
+type FileStat struct {
+	// Name is the file's name, without ".db".
+	Name    string
+	Started time.Time
+	// Bytes includes the write-ahead log. It's checked at most once every second, and left zero for TimeRotation.
+	Bytes int64
+	// Rows counts requests stored in the file, including those already processed and deleted
+	// by this process.
+	Rows int64
+}
+
+// TimeRotation starts a new file whenever the current time, formatted with Layout, changes.
+type TimeRotation struct {
+	Layout string
+	// Local names files in the local time zone, rather than UTC. Zone abbreviations are ambiguous,
+	// and local times repeat when clocks go back, so files may not be drained in the order they were started.
+	Local bool
+}
+
+func (tr TimeRotation) location() *time.Location {
+	if tr.Local {
+		return time.Local
+	}
+	return time.UTC
+}
+
+func (tr TimeRotation) FileName(t time.Time) string {
+	return t.In(tr.location()).Format(tr.Layout)
+}
+
+func (tr TimeRotation) Started(name string) (time.Time, bool) {
+	t, err := time.ParseInLocation(tr.Layout, name, tr.location())
+	return t, err == nil
+}
+
+func (tr TimeRotation) Rotate(cur FileStat, now time.Time) bool {
+	return tr.FileName(now) != cur.Name
+}
+
+// SizeLayout names the files started by SizeRotation.
+const SizeLayout = "2006-01-02T15-04-05.000000000Z"
+
+// SizeRotation starts a new file once the current one reaches MaxBytes or MaxRows, or is
+// MaxAge old, whichever comes first. Zero values are ignored. Sizes are checked at most once
+// a second, so a busy file can grow a little past MaxBytes. Files are named after when
+// they were started, in UTC, using SizeLayout.
+type SizeRotation struct {
+	MaxBytes int64
+	MaxRows  int64
+	MaxAge   time.Duration
+}
+
+func (sr SizeRotation) FileName(t time.Time) string {
+	return t.UTC().Format(SizeLayout)
+}
+
+func (sr SizeRotation) Started(name string) (time.Time, bool) {
+	t, err := time.Parse(SizeLayout, name)
+	return t, err == nil
+}
+
+func (sr SizeRotation) Rotate(cur FileStat, now time.Time) bool {
+	return (sr.MaxBytes > 0 && cur.Bytes >= sr.MaxBytes) ||
+		(sr.MaxRows > 0 && cur.Rows >= sr.MaxRows) ||
+		(sr.MaxAge > 0 && now.Sub(cur.Started) >= sr.MaxAge)
+}
+
+// sizeInterval is how long the current file's size is cached for rotation checks.
+const sizeInterval = time.Second
+
+// fileSize returns the size of the database file at path, and its write-ahead log.
+func fileSize(path string) int64 {
+	var size int64
+	for _, suffix := range []string{"", "-wal"} {
+		if fi, err := os.Stat(path + suffix); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
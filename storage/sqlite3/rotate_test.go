@@ -0,0 +1,98 @@
+package sqlite3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSizeRotation(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		name   string
+		policy SizeRotation
+		cur    FileStat
+		now    time.Time
+		want   bool
+	}{
+		{"no limits", SizeRotation{}, FileStat{Bytes: 1 << 40, Rows: 1 << 40}, started.Add(1000 * time.Hour), false},
+		{"under MaxBytes", SizeRotation{MaxBytes: 1000}, FileStat{Bytes: 999}, started, false},
+		{"at MaxBytes", SizeRotation{MaxBytes: 1000}, FileStat{Bytes: 1000}, started, true},
+		{"over MaxBytes", SizeRotation{MaxBytes: 1000}, FileStat{Bytes: 5000}, started, true},
+		{"under MaxRows", SizeRotation{MaxRows: 10}, FileStat{Rows: 9}, started, false},
+		{"at MaxRows", SizeRotation{MaxRows: 10}, FileStat{Rows: 10}, started, true},
+		{"under MaxAge", SizeRotation{MaxAge: time.Hour}, FileStat{}, started.Add(59 * time.Minute), false},
+		{"at MaxAge", SizeRotation{MaxAge: time.Hour}, FileStat{}, started.Add(time.Hour), true},
+		{"first limit reached", SizeRotation{MaxBytes: 1000, MaxRows: 10, MaxAge: time.Hour},
+			FileStat{Bytes: 10, Rows: 10}, started, true},
+		{"no limit reached", SizeRotation{MaxBytes: 1000, MaxRows: 10, MaxAge: time.Hour},
+			FileStat{Bytes: 999, Rows: 9}, started.Add(time.Minute), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.cur.Started = started
+			if got := c.policy.Rotate(c.cur, c.now); got != c.want {
+				t.Errorf("Rotate(%+v, %s) = %v, want %v", c.cur, c.now, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTimeRotation(t *testing.T) {
+	hour := TimeRotation{Layout: DateFormats["hour"]}
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	name := hour.FileName(now)
+	if name != "2024-05-01T12-UTC" {
+		t.Fatalf("FileName = %s", name)
+	}
+	for _, c := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{now, false},
+		{now.Add(29 * time.Minute), false},
+		{now.Add(30 * time.Minute), true},
+		{now.Add(-31 * time.Minute), true},
+		// The same instant in another zone is still the same hour in UTC.
+		{now.In(time.FixedZone("X", 3*3600)), false},
+	} {
+		if got := hour.Rotate(FileStat{Name: name}, c.now); got != c.want {
+			t.Errorf("Rotate at %s = %v, want %v", c.now, got, c.want)
+		}
+	}
+
+	local := TimeRotation{Layout: DateFormats["day"], Local: true}
+	if got, want := local.FileName(now), now.In(time.Local).Format(DateFormats["day"]); got != want {
+		t.Errorf("local FileName = %s, want %s", got, want)
+	}
+}
+
+func TestStarted(t *testing.T) {
+	when := time.Date(2024, 5, 1, 12, 34, 56, 789, time.UTC)
+	hour := TimeRotation{Layout: DateFormats["hour"]}
+	size := SizeRotation{MaxRows: 10}
+	for _, c := range []struct {
+		name   string
+		policy RotationPolicy
+		file   string
+		want   time.Time
+		ok     bool
+	}{
+		{"time", hour, hour.FileName(when), when.Truncate(time.Hour), true},
+		{"size", size, size.FileName(when), when, true},
+		{"size in another zone", size, size.FileName(when.In(time.FixedZone("X", 3600))), when, true},
+		{"time done", hour, hour.FileName(when) + ".done", time.Time{}, false},
+		{"size done", size, size.FileName(when) + ".done", time.Time{}, false},
+		{"time foreign", hour, "requests", time.Time{}, false},
+		{"size foreign", size, "requests", time.Time{}, false},
+		{"size of a time name", size, hour.FileName(when), time.Time{}, false},
+		{"time of a size name", hour, size.FileName(when), time.Time{}, false},
+		{"other interval", hour, TimeRotation{Layout: DateFormats["minute"]}.FileName(when), time.Time{}, false},
+		{"empty", size, "", time.Time{}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := c.policy.Started(c.file)
+			if ok != c.ok || (ok && !got.Equal(c.want)) {
+				t.Errorf("Started(%q) = %s, %v; want %s, %v", c.file, got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
@@ -2,25 +2,27 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	re "regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SparkPost/httpdump/storage"
 	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
-// https://www.sqlite.org/rescode.html
-const (
-	SQLITE_LOCKED = 6
-)
-
-// Map shortcuts strings to verbose date formats.
+// DateFormats maps the built-in rotation intervals to TimeRotation layouts.
+// File names are formatted in UTC, unless the TimeRotation is Local.
 var DateFormats = map[string]string{
 	"day":    "2006-01-02T-MST",
 	"hour":   "2006-01-02T15-MST",
@@ -28,16 +30,65 @@ var DateFormats = map[string]string{
 }
 
 type SQLiteDumper struct {
-	dbPath        string
-	inMemory      bool
-	dateFormat    string
-	curDate       string
-	curDateRWLock *sync.RWMutex
-	dbh           *sql.DB
-	dbhRWLock     *sync.RWMutex
+	dbPath     string
+	inMemory   bool
+	dateFormat string
+	dbh        *sql.DB
+	dbhRWLock  *sync.RWMutex
+	// rotation decides when to start a new file, in rotated mode.
+	rotation RotationPolicy
+	// curFile is the path of the file dbh has open, and curStarted and curRows describe it.
+	curFile    string
+	curStarted time.Time
+	curRows    int64
+	// curSize caches the current file's size, as of sizeChecked (in Unix nanoseconds), for rotationDue.
+	curSize     int64
+	sizeChecked int64
+	// closed is set by Close, so Dump doesn't open a new file afterwards.
+	closed bool
+	// oldDBs are handles for rotated files still being drained, and batchFiles
+	// maps batches marked or rebatched in rotated mode to the files holding their requests.
+	oldDBs     map[string]*sql.DB
+	batchFiles map[int64][]string
+	// checked holds rotated files whose stranded batches markOldBatch has requeued.
+	checked map[string]bool
+	// readOnly is set by OpenExisting.
+	readOnly bool
+	// dirLock is held shared on dbPath in rotated mode, so stranded batches are only requeued
+	// when no other process might be working on them.
+	dirLock   *dirLock
+	drainLock *sync.Mutex
+	// dbFile, if set, is the one database file used instead of rotating files.
+	dbFile string
+	// budgetExceeded is set by Maintain while Dump should return ErrOverBudget.
+	budgetExceeded int32
+	// busyTimeout is how long a connection waits for another's lock, before failing with SQLITE_BUSY.
+	busyTimeout time.Duration
+	// Retain keeps requests after their batch is done, setting done instead of deleting them.
+	// They can then be deleted with Purge.
+	Retain bool
+	// Retry bounds retries of operations that still fail with SQLITE_BUSY or SQLITE_LOCKED.
+	Retry RetryPolicy
+}
+
+// Options configures how NewDumperOptions opens database files. A zero BusyTimeout or Retry
+// is taken from DefaultOptions.
+type Options struct {
+	// BusyTimeout is how long a connection waits for another's lock, before failing with SQLITE_BUSY.
+	BusyTimeout time.Duration
+	Retry       RetryPolicy
+	// Rotation, if set, is used instead of a built-in rotation interval, when dateFmt is empty.
+	Rotation RotationPolicy
+}
+
+// DefaultOptions are used by NewDumper.
+var DefaultOptions = Options{
+	BusyTimeout: 5 * time.Second,
+	Retry:       DefaultRetryPolicy,
 }
 
 // reopenDBFile opens a database handle and initializes the schema if necessary.
+// dbfile is the path of the database file, or the in-memory database's URI.
 func (ctx *SQLiteDumper) reopenDBFile(dbfile string) error {
 	mustInit := false
 	if ctx.inMemory == true {
@@ -48,8 +99,7 @@ func (ctx *SQLiteDumper) reopenDBFile(dbfile string) error {
 		}
 
 	} else {
-		filePath := fmt.Sprintf("%s/%s", ctx.dbPath, dbfile)
-		file, err := os.Open(filePath)
+		file, err := os.Open(dbfile)
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return err
@@ -61,11 +111,36 @@ func (ctx *SQLiteDumper) reopenDBFile(dbfile string) error {
 		}
 	}
 
-	dbh, err := sql.Open("sqlite3", dbfile)
+	dsn := dbfile
+	if !ctx.inMemory {
+		dsn = ctx.fileDSN(dbfile)
+	}
+	dbh, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return err
 	}
-	if err = dbh.Ping(); err != nil {
+	if err = ctx.initDB(dbh, dbfile, mustInit); err != nil {
+		dbh.Close()
+		if mustInit && !ctx.inMemory {
+			// Don't leave a file without a schema behind, or it'll be opened as if it had one.
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(dbfile + suffix)
+			}
+		}
+		return err
+	}
+
+	ctx.dbh = dbh
+	ctx.curFile = dbfile
+	atomic.StoreInt64(&ctx.sizeChecked, 0)
+	return nil
+}
+
+// initDB checks a newly opened handle, creates the schema if mustInit is set, or migrates it,
+// and, when rotating, loads the file's details for the rotation policy.
+func (ctx *SQLiteDumper) initDB(dbh *sql.DB, dbfile string, mustInit bool) error {
+	err := dbh.Ping()
+	if err != nil {
 		return err
 	}
 
@@ -77,9 +152,11 @@ func (ctx *SQLiteDumper) reopenDBFile(dbfile string) error {
 				head  blob,
 				data  blob,
 				date  timestamp,
-				batch int
+				batch int,
+				done  timestamp
 			)`,
 			`CREATE INDEX raw_requests_batch_idx ON raw_requests (batch)`,
+			`CREATE INDEX raw_requests_done_idx ON raw_requests (done)`,
 		}
 		for _, ddl := range ddls {
 			_, err := dbh.Exec(ddl, nil)
@@ -87,24 +164,63 @@ func (ctx *SQLiteDumper) reopenDBFile(dbfile string) error {
 				return err
 			}
 		}
+		if ctx.rotating() {
+			if err = ctx.seedSequence(dbh, dbfile); err != nil {
+				return err
+			}
+		}
+	} else if err = migrate(dbh); err != nil {
+		return err
+	}
+
+	if ctx.rotating() {
+		var rows int64
+		if err = dbh.QueryRow(`SELECT count(*) FROM raw_requests`).Scan(&rows); err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(dbfile), ".db")
+		ctx.curStarted, _ = ctx.rotation.Started(name)
+		atomic.StoreInt64(&ctx.curRows, rows)
 	}
 
-	ctx.dbh = dbh
 	return nil
 }
 
-// setCurDate writes a new value into the curDate global.
-func (ctx *SQLiteDumper) setCurDate(nowstr string) {
-	ctx.curDateRWLock.Lock()
-	defer ctx.curDateRWLock.Unlock()
-	ctx.curDate = nowstr
+// fileDSN returns the connection string for the database file at path. Files are opened in
+// WAL mode, so readers don't block the writer. New files are created with incremental
+// auto-vacuum, so Maintain can return free pages without rewriting the file.
+func (sqld *SQLiteDumper) fileDSN(path string) string {
+	return fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d&_auto_vacuum=incremental",
+		path, sqld.busyTimeout.Milliseconds())
 }
 
-// getCurDate reads the current value from the curDate global.
-func (ctx *SQLiteDumper) getCurDate() string {
-	ctx.curDateRWLock.RLock()
-	defer ctx.curDateRWLock.RUnlock()
-	return fmt.Sprintf("%s", ctx.curDate)
+// existingDSN is like fileDSN, but opening fails if the file doesn't exist, rather than create it.
+// SQLite only takes the mode from a URI.
+func (sqld *SQLiteDumper) existingDSN(path string) string {
+	return "file:" + sqld.fileDSN(path) + "&mode=rw"
+}
+
+// migrate adds columns introduced after a database file was created.
+func migrate(dbh *sql.DB) error {
+	var n int
+	err := dbh.QueryRow(`SELECT count(*) FROM pragma_table_info('raw_requests') WHERE name = 'done'`).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	log.Printf("Adding column [done] to raw_requests\n")
+	ddls := []string{
+		`ALTER TABLE raw_requests ADD COLUMN done timestamp`,
+		`CREATE INDEX raw_requests_done_idx ON raw_requests (done)`,
+	}
+	for _, ddl := range ddls {
+		if _, err = dbh.Exec(ddl); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // updateCurDate makes sure we're writing to the correct db file.
@@ -118,138 +234,349 @@ func (ctx *SQLiteDumper) updateCurDate(now time.Time) error {
 			}
 		}
 
-	} else {
-		cur := ctx.getCurDate()
-		nowstr := now.Format(DateFormats[ctx.dateFormat])
-		// If the date has changed since the last time we checked, open the new file.
-		if cur != nowstr {
-			ctx.setCurDate(nowstr)
-			dbfile := fmt.Sprintf("%s.db", nowstr)
-			ctx.dbhRWLock.Lock()
-			defer ctx.dbhRWLock.Unlock()
-			if ctx.dbh != nil {
-				ctx.dbh.Close()
-			}
-			err := ctx.reopenDBFile(dbfile)
+	} else if ctx.dbFile != "" {
+		if ctx.dbh == nil {
+			log.Printf("Opening database [%s]\n", ctx.dbFile)
+			err := ctx.reopenDBFile(ctx.dbFile)
 			if err != nil {
 				return err
 			}
 		}
+
+	} else {
+		// Check whether it's time for a new file under the read lock, so concurrent Dumps don't
+		// wait on each other, then again under the write lock, in case another Dump rotated first.
+		// The write lock waits for Dumps still writing to the old file.
+		ctx.dbhRWLock.RLock()
+		due := ctx.rotationDue(now)
+		ctx.dbhRWLock.RUnlock()
+		if !due {
+			return nil
+		}
+
+		ctx.dbhRWLock.Lock()
+		defer ctx.dbhRWLock.Unlock()
+		if !ctx.rotationDue(now) {
+			return nil
+		}
+		dbfile := filepath.Join(ctx.dbPath, ctx.rotation.FileName(now)+".db")
+		if ctx.dbh != nil {
+			if dbfile == ctx.curFile {
+				return nil
+			}
+			log.Printf("Rotating database [%s] to [%s]\n", ctx.curFile, dbfile)
+			ctx.dbh.Close()
+			ctx.dbh = nil
+		}
+		err := ctx.reopenDBFile(dbfile)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-var dbPattern *re.Regexp = re.MustCompile(`\w+.db`)
+// rotate opens a new file, if the rotation policy says it's time.
+func (sqld *SQLiteDumper) rotate() error {
+	if !sqld.rotating() {
+		return nil
+	}
+	return sqld.updateCurDate(time.Now())
+}
+
+// rotationDue reports whether a new file should be opened. The caller must hold dbhRWLock.
+func (ctx *SQLiteDumper) rotationDue(now time.Time) bool {
+	if ctx.closed {
+		return false
+	} else if ctx.dbh == nil {
+		return true
+	}
+	cur := FileStat{
+		Name:    strings.TrimSuffix(filepath.Base(ctx.curFile), ".db"),
+		Started: ctx.curStarted,
+		Rows:    atomic.LoadInt64(&ctx.curRows),
+	}
+	// Time-based rotation doesn't need the size, so the file isn't checked on every Dump.
+	if _, ok := ctx.rotation.(TimeRotation); !ok {
+		cur.Bytes = ctx.curBytes(now)
+	}
+	return ctx.rotation.Rotate(cur, now)
+}
+
+// curBytes returns the size of the current file and its write-ahead log, checking it at most
+// once every sizeInterval, since it's asked for on every Dump. The caller must hold dbhRWLock.
+func (ctx *SQLiteDumper) curBytes(now time.Time) int64 {
+	if now.UnixNano()-atomic.LoadInt64(&ctx.sizeChecked) < int64(sizeInterval) {
+		return atomic.LoadInt64(&ctx.curSize)
+	}
+	size := fileSize(ctx.curFile)
+	atomic.StoreInt64(&ctx.curSize, size)
+	atomic.StoreInt64(&ctx.sizeChecked, now.UnixNano())
+	return size
+}
+
+// ErrReadOnly is returned by Dump, DumpMany and MarkBatch on a SQLiteDumper opened with OpenExisting.
+var ErrReadOnly = errors.New("sqlite3: opened read-only, with OpenExisting")
+
+var dbPattern *re.Regexp = re.MustCompile(`\.db$`)
 
 // NewDumper returns an initialized SQLiteDumper that dumps request data to an SQLite db file.
+// dateFmt is `day`, `hour` or `minute`, to rotate files named after the current UTC time in dbPath,
+// `memory`, or the name of a single file ending in `.db`. A bare file name is placed in dbPath;
+// a path with a directory is used as is.
 func NewDumper(dateFmt, dbPath string) (*SQLiteDumper, error) {
-	inMemory := false
-	if dateFmt == "memory" {
-		// Use an in-memory database
-		inMemory = true
-		// With a shared cache: http://www.sqlite.org/sharedcache.html
-		dateFmt = "file:foo.db?cache=shared&mode=memory"
+	return NewDumperOptions(dateFmt, dbPath, DefaultOptions)
+}
 
-		//} else if dbPattern.MatchString(dateFmt) {
-		// TODO: if dateFmt matches "\w+.db", use that as the db filename
+// NewDumperOptions is NewDumper, opening files with the given options. If opts.Rotation is set,
+// dateFmt must be empty, and files in dbPath are rotated according to it.
+func NewDumperOptions(dateFmt, dbPath string, opts Options) (*SQLiteDumper, error) {
+	sqld, err := newDumper(dateFmt, dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	} else if dateFmt != "day" && dateFmt != "hour" && dateFmt != "minute" {
-		// Use a dynamic filename based on the current time.
-		return nil, fmt.Errorf("`datefmt` must be one of (`day`, `hour`, `minute`), not [%s]", dateFmt)
+	if !sqld.inMemory {
+		dir := dbPath
+		if sqld.dbFile != "" {
+			dir = filepath.Dir(sqld.dbFile)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("sqlite3.NewDumper (MkdirAll): %s", err)
+		}
 	}
 
-	// Set up a dumper, configured with the provided date granularity.
-	sqld := &SQLiteDumper{
-		dbPath:        dbPath,
-		inMemory:      inMemory,
-		dateFormat:    dateFmt,
-		curDateRWLock: &sync.RWMutex{},
-		dbhRWLock:     &sync.RWMutex{},
+	if sqld.rotating() {
+		if sqld.dirLock, err = lockDir(dbPath); err != nil {
+			return nil, fmt.Errorf("sqlite3.NewDumper (lock): %s", err)
+		}
 	}
 
 	// Make sure we're using the db file for "right now", and
 	// make sure the database handle is initialized right away
-	err := sqld.updateCurDate(time.Now())
+	err = sqld.updateCurDate(time.Now())
 	if err != nil {
+		if sqld.dirLock != nil {
+			sqld.dirLock.Close()
+		}
 		return nil, err
 	}
 
 	return sqld, nil
 }
 
-func QueryRetry(db *sql.DB, codes map[int]bool, after time.Duration, query string, args ...interface{}) (*sql.Rows, error) {
-	for {
-		rows, err := db.Query(query, args...)
+// OpenExisting is NewDumperOptions for looking at what's already stored. It never creates, rotates or
+// finishes files: the newest existing file is used as the current one, and Dump, DumpMany and MarkBatch
+// return ErrReadOnly. It fails if there are no files to open, or with the in-memory database.
+func OpenExisting(dateFmt, dbPath string, opts Options) (*SQLiteDumper, error) {
+	sqld, err := newDumper(dateFmt, dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	sqld.readOnly = true
+
+	path := sqld.dbFile
+	if sqld.inMemory {
+		return nil, fmt.Errorf("sqlite3.OpenExisting: the in-memory database has nothing stored")
+	} else if sqld.rotating() {
+		paths, err := sqld.historyFiles("")
 		if err != nil {
-			if sqlErr, ok := err.(sqlite3.Error); ok {
-				if _, ok := codes[int(sqlErr.Code)]; ok {
-					// delay for the specified amount of time before retrying
-					select {
-					case <-time.After(after):
-					}
-				} else {
-					return nil, fmt.Errorf("%s: %d/%d", err, int(sqlErr.Code), int(sqlErr.ExtendedCode))
-				}
-			} else {
-				log.Printf("Couldn't convert error to sqlite3.Error")
-				return nil, err
-			}
-		} else {
-			return rows, err
+			return nil, fmt.Errorf("sqlite3.OpenExisting (Glob): %s", err)
+		} else if len(paths) == 0 {
+			return nil, fmt.Errorf("sqlite3.OpenExisting: no database files in [%s]", dbPath)
 		}
+		path = paths[len(paths)-1]
 	}
+	if _, err = os.Stat(path); err != nil {
+		return nil, fmt.Errorf("sqlite3.OpenExisting: %s", err)
+	}
+
+	if sqld.dbh, err = sqld.openFile(path); err != nil {
+		return nil, fmt.Errorf("sqlite3.OpenExisting: [%s]: %s", path, err)
+	}
+	sqld.curFile = path
+	return sqld, nil
 }
 
-func ExecRetry(db *sql.DB, codes map[int]bool, after time.Duration, query string, args ...interface{}) (sql.Result, error) {
-	for {
-		res, err := db.Exec(query, args...)
-		if err != nil {
-			if sqlErr, ok := err.(sqlite3.Error); ok {
-				if _, ok := codes[int(sqlErr.Code)]; ok {
-					// delay for the specified amount of time before retrying
-					select {
-					case <-time.After(after):
-					}
-				} else {
-					return nil, fmt.Errorf("%s: %d/%d", err, int(sqlErr.Code), int(sqlErr.ExtendedCode))
-				}
-			} else {
-				log.Printf("Couldn't convert error to sqlite3.Error")
-				return nil, err
-			}
-		} else {
-			return res, err
+// newDumper checks the arguments to NewDumperOptions or OpenExisting, and sets up a dumper
+// with no files open.
+func newDumper(dateFmt, dbPath string, opts Options) (*SQLiteDumper, error) {
+	if opts.BusyTimeout == 0 {
+		opts.BusyTimeout = DefaultOptions.BusyTimeout
+	}
+	if opts.Retry == (RetryPolicy{}) {
+		opts.Retry = DefaultOptions.Retry
+	}
+	inMemory := false
+	dbFile := ""
+	var rotation RotationPolicy
+	if dateFmt == "memory" {
+		// Use an in-memory database
+		inMemory = true
+		// With a shared cache: http://www.sqlite.org/sharedcache.html
+		dateFmt = fmt.Sprintf("file:foo.db?cache=shared&mode=memory&_busy_timeout=%d", opts.BusyTimeout.Milliseconds())
+
+	} else if dbPattern.MatchString(dateFmt) {
+		// Use a single database file, which is never rotated.
+		dbFile = dateFmt
+		if filepath.Base(dbFile) == dbFile {
+			dbFile = filepath.Join(dbPath, dbFile)
 		}
+
+	} else if dateFmt == "" && opts.Rotation != nil {
+		// Use filenames, and rotate files, as the caller's policy says.
+		rotation = opts.Rotation
+
+	} else if layout, ok := DateFormats[dateFmt]; ok && opts.Rotation == nil {
+		// Use a dynamic filename based on the current time.
+		rotation = TimeRotation{Layout: layout}
+
+	} else {
+		return nil, fmt.Errorf("`datefmt` must be one of (`day`, `hour`, `minute`, `memory`) or a file ending in `.db`, not [%s]", dateFmt)
 	}
+
+	// Rotated files must be found again, to be drained after a restart.
+	if rotation != nil {
+		name := rotation.FileName(time.Now())
+		if _, ok := rotation.Started(name); !ok || name == "" || strings.ContainsRune(name, os.PathSeparator) {
+			return nil, fmt.Errorf("sqlite3.NewDumper: rotation names files [%s], which can't be used or read back", name)
+		}
+	}
+
+	// Set up a dumper, configured with the provided date granularity.
+	return &SQLiteDumper{
+		dbPath:      dbPath,
+		inMemory:    inMemory,
+		dbFile:      dbFile,
+		dateFormat:  dateFmt,
+		rotation:    rotation,
+		dbhRWLock:   &sync.RWMutex{},
+		oldDBs:      map[string]*sql.DB{},
+		batchFiles:  map[int64][]string{},
+		checked:     map[string]bool{},
+		drainLock:   &sync.Mutex{},
+		busyTimeout: opts.BusyTimeout,
+		Retry:       opts.Retry,
+	}, nil
 }
 
 func (sqld *SQLiteDumper) Dump(req *storage.Request) error {
+	return sqld.DumpContext(context.Background(), req)
+}
+
+// DumpContext is Dump, giving up on retries once ctx is done.
+func (sqld *SQLiteDumper) DumpContext(ctx context.Context, req *storage.Request) error {
+	defer storage.TimeBackend("sqlite3", "dump")()
+	if sqld.readOnly {
+		return ErrReadOnly
+	} else if sqld.overBudget() {
+		return ErrOverBudget
+	}
+	if err := sqld.rotate(); err != nil {
+		return err
+	}
 	// Get a "read lock" on our db pool, if needed.
 	// The in-memory db doesn't need a lock since it won't change after the first init.
 	if sqld.inMemory == false {
 		sqld.dbhRWLock.RLock()
 		defer sqld.dbhRWLock.RUnlock()
 	}
+	if sqld.dbh == nil {
+		return fmt.Errorf("sqlite3.Dump: nil database handle")
+	}
 
-	// Insert data for the current request, retrying on SQL_LOCKED.
-	_, err := ExecRetry(sqld.dbh, map[int]bool{SQLITE_LOCKED: true}, (10 * time.Millisecond), `
+	// Insert data for the current request, retrying while the database is busy or locked.
+	_, err := ExecRetry(ctx, sqld.dbh, &sqld.Retry, "dump", `
 			INSERT INTO raw_requests (head, data, date)
 			VALUES ($1, $2, $3)
 		`, string(req.Head), string(req.Data), req.When)
 	if err != nil {
 		return err
 	}
+	atomic.AddInt64(&sqld.curRows, 1)
+	return nil
+}
+
+// DumpMany stores several requests in one transaction, retrying the whole transaction while
+// the database is busy or locked.
+func (sqld *SQLiteDumper) DumpMany(reqs []*storage.Request) error {
+	defer storage.TimeBackend("sqlite3", "dump_many")()
+	if sqld.readOnly {
+		return ErrReadOnly
+	} else if sqld.overBudget() {
+		return ErrOverBudget
+	}
+	if err := sqld.rotate(); err != nil {
+		return err
+	}
+	defer sqld.rlock()()
+	if sqld.dbh == nil {
+		return fmt.Errorf("sqlite3.DumpMany: nil database handle")
+	}
+	err := sqld.Retry.Do(context.Background(), "dump_many", func() error {
+		return sqld.dumpMany(reqs)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&sqld.curRows, int64(len(reqs)))
 	return nil
 }
 
+func (sqld *SQLiteDumper) dumpMany(reqs []*storage.Request) error {
+	tx, err := sqld.dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO raw_requests (head, data, date)
+		VALUES ($1, $2, $3)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, req := range reqs {
+		if _, err = stmt.Exec(string(req.Head), string(req.Data), req.When); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MarkBatch marks pending requests as a new batch. In rotated mode, older files in dbPath
+// that still have pending requests are drained first, oldest first.
 func (sqld *SQLiteDumper) MarkBatch() (int64, error) {
+	defer storage.TimeBackend("sqlite3", "mark_batch")()
+	if sqld.readOnly {
+		return 0, ErrReadOnly
+	}
+	if sqld.rotating() {
+		if batchID := sqld.markOldBatch(); batchID != 0 {
+			return batchID, nil
+		}
+	}
+
+	defer sqld.rlock()()
 	if sqld.dbh == nil {
-		log.Printf("MarkBatch: Can't write to nil database handle!\n")
-		return 0, nil
+		return 0, fmt.Errorf("sqlite3.MarkBatch: nil database handle")
 	}
+	batchID, err := markBatch(sqld.dbh, &sqld.Retry)
+	if err != nil || batchID == 0 || !sqld.rotating() {
+		return batchID, err
+	}
+	sqld.drainLock.Lock()
+	sqld.batchFiles[batchID] = []string{sqld.curFile}
+	sqld.drainLock.Unlock()
+	return batchID, nil
+}
 
-	// Get value of largest ID, retrying on SQL_LOCKED.
-	rows, err := QueryRetry(sqld.dbh, map[int]bool{SQLITE_LOCKED: true}, (10 * time.Millisecond), `
+// markBatch marks pending requests in dbh as a new batch, and returns its ID, or zero if there were none.
+func markBatch(dbh *sql.DB, rp *RetryPolicy) (int64, error) {
+	// Get value of largest ID, retrying while the database is busy or locked.
+	rows, err := QueryRetry(context.Background(), dbh, rp, "mark_batch", `
 		SELECT max(id) FROM raw_requests
 		 WHERE (batch == 0 OR batch IS NULL)
 	`)
@@ -273,8 +600,8 @@ func (sqld *SQLiteDumper) MarkBatch() (int64, error) {
 		return 0, nil
 	}
 
-	// Update batch to the value of the largest ID in the current batch, retrying on SQL_LOCKED.
-	res, err := ExecRetry(sqld.dbh, map[int]bool{SQLITE_LOCKED: true}, (10 * time.Millisecond), `
+	// Update batch to the value of the largest ID in the current batch, retrying while the database is busy or locked.
+	res, err := ExecRetry(context.Background(), dbh, rp, "mark_batch", `
 		UPDATE raw_requests SET batch = $1
 		 WHERE (batch == 0 OR batch IS NULL)
 		   AND id <= $1
@@ -293,27 +620,51 @@ func (sqld *SQLiteDumper) MarkBatch() (int64, error) {
 }
 
 func (sqld *SQLiteDumper) ReadRequests(batchID int64) ([]storage.Request, error) {
+	defer storage.TimeBackend("sqlite3", "read_requests")()
 	// TODO: make initial size configurable
 	reqs := make([]storage.Request, 0, 32)
-	n := 0
 
-	// Get all requests for this batch, retrying on SQL_LOCKED.
-	rows, err := QueryRetry(sqld.dbh, map[int]bool{SQLITE_LOCKED: true}, (10 * time.Millisecond), `
+	dbhs, release, err := sqld.batchDBs(batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	for _, dbh := range dbhs {
+		if reqs, err = readBatch(dbh, &sqld.Retry, batchID, reqs); err != nil {
+			return nil, err
+		}
+	}
+	if len(dbhs) > 1 {
+		sort.SliceStable(reqs, func(i, j int) bool {
+			if reqs[i].When.Equal(reqs[j].When) {
+				return *reqs[i].ID < *reqs[j].ID
+			}
+			return reqs[i].When.Before(reqs[j].When)
+		})
+	}
+	return reqs, nil
+}
+
+// readBatch appends the requests in batchID stored in dbh to reqs.
+func readBatch(dbh *sql.DB, rp *RetryPolicy, batchID int64, reqs []storage.Request) ([]storage.Request, error) {
+	// Get all requests for this batch, retrying while the database is busy or locked.
+	rows, err := QueryRetry(context.Background(), dbh, rp, "read_requests", `
 			SELECT id, head, data, date
 			  FROM raw_requests
 			 WHERE batch == $1
-			 ORDER BY date ASC
+			 ORDER BY date ASC, id ASC
 		`, batchID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var tmpID int64
 	for rows.Next() {
 		if rows.Err() == io.EOF {
 			break
 		}
+		var tmpID int64
 		req := &storage.Request{}
 		err = rows.Scan(&tmpID, &req.Head, &req.Data, &req.When)
 		if err != nil {
@@ -322,23 +673,222 @@ func (sqld *SQLiteDumper) ReadRequests(batchID int64) ([]storage.Request, error)
 		req.ID = &tmpID
 
 		reqs = append(reqs, *req)
-		n++
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	rows.Close()
-
 	return reqs, nil
 }
 
 func (sqld *SQLiteDumper) BatchDone(batchID int64) error {
-	_, err := ExecRetry(sqld.dbh, map[int]bool{SQLITE_LOCKED: true}, (10 * time.Millisecond), `
-		DELETE FROM raw_requests
-		 WHERE batch = $1
-	`, batchID)
+	defer storage.TimeBackend("sqlite3", "batch_done")()
+	dbhs, release, err := sqld.batchDBs(batchID)
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	for _, dbh := range dbhs {
+		if sqld.Retain {
+			_, err = ExecRetry(context.Background(), dbh, &sqld.Retry, "batch_done", `
+				UPDATE raw_requests SET done = $1
+				 WHERE batch = $2 AND done IS NULL
+			`, time.Now().UTC(), batchID)
+		} else {
+			_, err = ExecRetry(context.Background(), dbh, &sqld.Retry, "batch_done", `
+				DELETE FROM raw_requests
+				 WHERE batch = $1
+			`, batchID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sqld.forgetBatch(batchID)
 	return nil
 }
+
+// Rebatch moves the given requests into a new batch, clearing done, so they can be processed again.
+// In rotated mode, requests are found in every file, including finished ones kept with Retain, which
+// are renamed back so they're drained again. The batch ID is taken from the current file's autoincrement
+// sequence, so it won't collide with batches from MarkBatch in any file.
+func (sqld *SQLiteDumper) Rebatch(ids []int64) (int64, error) {
+	defer storage.TimeBackend("sqlite3", "rebatch")()
+	defer sqld.rlock()()
+	if sqld.dbh == nil {
+		return 0, fmt.Errorf("sqlite3.Rebatch: nil database handle")
+	}
+	var batchID int64
+	err := sqld.Retry.Do(context.Background(), "rebatch", func() error {
+		var err error
+		batchID, err = nextBatchID(sqld.dbh)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, batchID)
+	marks := make([]string, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+		marks = append(marks, fmt.Sprintf("$%d", len(args)))
+	}
+	query := fmt.Sprintf(`
+		UPDATE raw_requests SET batch = $1, done = NULL
+		 WHERE id IN (%s)
+	`, strings.Join(marks, ", "))
+
+	paths := []string{}
+	err = sqld.eachFile(func(path string, dbh *sql.DB) error {
+		res, err := ExecRetry(context.Background(), dbh, &sqld.Retry, "rebatch", query, args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sqld.rotating() {
+		sqld.drainLock.Lock()
+		defer sqld.drainLock.Unlock()
+		for i, path := range paths {
+			if !isDone(path) {
+				continue
+			}
+			if paths[i], err = sqld.reopenFile(path); err != nil {
+				return 0, fmt.Errorf("sqlite3.Rebatch (rename): %s", err)
+			}
+		}
+		sqld.batchFiles[batchID] = paths
+	}
+	return batchID, nil
+}
+
+// nextBatchID takes a new ID from dbh's autoincrement sequence, for a batch that isn't marked by MarkBatch.
+func nextBatchID(dbh *sql.DB) (int64, error) {
+	tx, err := dbh.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE sqlite_sequence SET seq = seq + 1 WHERE name = 'raw_requests'`)
+	if err != nil {
+		return 0, err
+	}
+	var batchID int64
+	err = tx.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'raw_requests'`).Scan(&batchID)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return batchID, nil
+}
+
+// Backlog reports how many requests haven't been processed yet, in every file, and when
+// the oldest one arrived.
+func (sqld *SQLiteDumper) Backlog() (int64, time.Time, error) {
+	defer storage.TimeBackend("sqlite3", "backlog")()
+	defer sqld.rlock()()
+
+	var total int64
+	var first time.Time
+	err := sqld.eachFile(func(path string, dbh *sql.DB) error {
+		rows, err := QueryRetry(context.Background(), dbh, &sqld.Retry, "backlog", `
+			SELECT count(*), min(date) FROM raw_requests
+			 WHERE done IS NULL
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return rows.Err()
+		}
+		var pending int64
+		var oldest sql.NullString
+		if err = rows.Scan(&pending, &oldest); err != nil {
+			return err
+		}
+		total += pending
+		if !oldest.Valid {
+			return nil
+		}
+		when, err := parseTimestamp(oldest.String)
+		if err != nil {
+			return err
+		}
+		if first.IsZero() || when.Before(first) {
+			first = when
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return total, first, nil
+}
+
+// parseTimestamp parses a timestamp as stored by go-sqlite3, for aggregates
+// like min(date) whose result doesn't carry the column's declared type.
+func parseTimestamp(s string) (time.Time, error) {
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("sqlite3: unrecognized timestamp [%s]", s)
+}
+
+// Purge deletes requests whose batch was marked done before t, when Retain is set, in every file,
+// including finished ones. Finished files themselves are expired by Maintain.
+func (sqld *SQLiteDumper) Purge(t time.Time) (int64, error) {
+	defer storage.TimeBackend("sqlite3", "purge")()
+	defer sqld.rlock()()
+	return sqld.execEach("purge", `
+		DELETE FROM raw_requests
+		 WHERE julianday(done) < julianday($1)
+	`, t.UTC())
+}
+
+// Ping checks that the current database file is reachable.
+func (sqld *SQLiteDumper) Ping() error {
+	if sqld.inMemory == false {
+		sqld.dbhRWLock.RLock()
+		defer sqld.dbhRWLock.RUnlock()
+	}
+	if sqld.dbh == nil {
+		return fmt.Errorf("sqlite3.Ping: nil database handle")
+	}
+	return sqld.dbh.Ping()
+}
+
+// Close closes the current database handle, and any rotated files being drained.
+func (sqld *SQLiteDumper) Close() error {
+	sqld.dbhRWLock.Lock()
+	defer sqld.dbhRWLock.Unlock()
+	sqld.drainLock.Lock()
+	for path, dbh := range sqld.oldDBs {
+		dbh.Close()
+		delete(sqld.oldDBs, path)
+	}
+	sqld.drainLock.Unlock()
+	if sqld.dirLock != nil && !sqld.closed {
+		sqld.dirLock.Close()
+	}
+	sqld.closed = true
+	if sqld.dbh == nil {
+		return nil
+	}
+	err := sqld.dbh.Close()
+	sqld.dbh = nil
+	return err
+}
@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	iou "io/ioutil"
 	"log"
@@ -14,6 +17,33 @@ type Dumper interface {
 	Dump(*Request) error
 }
 
+// ContextDumper is implemented by Dumpers that can stop retrying or waiting once ctx is done,
+// such as when the client that sent the request goes away.
+type ContextDumper interface {
+	DumpContext(ctx context.Context, req *Request) error
+}
+
+// Notifier is implemented by backends that announce newly stored requests,
+// so they can be processed right away instead of on the next tick.
+type Notifier interface {
+	// Notifications returns a channel that receives a value after requests are stored.
+	// Values may be coalesced. The channel is closed once ctx is done.
+	Notifications(ctx context.Context) (<-chan struct{}, error)
+}
+
+// Elector chooses one of several processes sharing a backend to process batches.
+type Elector interface {
+	// Campaign tries to become and stay the leader until ctx is done, then steps down.
+	Campaign(ctx context.Context)
+	// Leading reports whether this process is the leader, and since when.
+	Leading() (bool, time.Time)
+}
+
+// ManyDumper is implemented by backends that can store several requests at once, in one transaction.
+type ManyDumper interface {
+	DumpMany(reqs []*Request) error
+}
+
 // Request contains the various pieces of one http.Request, packaged up for easy reading or writing.
 // The id field is intended to be read-only, to uniquely identify a request to Batcher.BatchDone.
 type Request struct {
@@ -22,6 +52,8 @@ type Request struct {
 	Data  []byte
 	When  time.Time
 	Batch *int
+	// Done is when the request's batch was marked done, for backends that keep processed requests.
+	Done *time.Time
 }
 
 func (req *Request) String() string {
@@ -41,6 +73,21 @@ func (req *Request) String() string {
 		idStr, string(req.Head), req.When.Format(time.RFC3339), batchStr)
 }
 
+// HTTPRequest rebuilds an *http.Request from the stored headers and body.
+// The returned request has RequestURI set, like one received by a server,
+// so it must be copied into a new request before it can be sent.
+func (req *Request) HTTPRequest() (*http.Request, error) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.Head)))
+	if err != nil {
+		return nil, err
+	}
+	// The stored body was already de-chunked, so describe it as-is.
+	r.TransferEncoding = nil
+	r.ContentLength = int64(len(req.Data))
+	r.Body = iou.NopCloser(bytes.NewReader(req.Data))
+	return r, nil
+}
+
 // Batcher reads stored HTTP requests in a batch, marking them as processed when done.
 type Batcher interface {
 	MarkBatch() (batchID int64, err error)
@@ -59,24 +106,31 @@ type DumpBatcher interface {
 }
 
 func ProcessBatch(b Batcher, p Processor) (int, error) {
+	start := time.Now()
 	batchID, err := b.MarkBatch()
 	if err != nil {
 		return 0, err
 	}
 	if batchID == 0 {
+		setLastBatch(time.Now())
 		return 0, nil
 	}
+	defer func() {
+		ProcessBatchDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	reqs, err := b.ReadRequests(batchID)
 	if err != nil {
 		return 0, err
 	}
 	if len(reqs) == 0 {
+		setLastBatch(time.Now())
 		return 0, nil
 	}
 
 	err = p.ProcessRequests(reqs)
 	if err != nil {
+		ProcessorErrors.Inc()
 		return 0, err
 	}
 
@@ -85,9 +139,37 @@ func ProcessBatch(b Batcher, p Processor) (int, error) {
 		return 0, err
 	}
 
+	Batches.Inc()
+	BatchSize.Observe(float64(len(reqs)))
+	setLastBatch(time.Now())
 	return len(reqs), nil
 }
 
+// ProcessBatchContext runs ProcessBatch, but stops waiting for it and returns ctx.Err()
+// if ctx is done first. ProcessBatch can't be interrupted, so it may still be running
+// in the background when this returns.
+func ProcessBatchContext(ctx context.Context, b Batcher, p Processor) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := ProcessBatch(b, p)
+		done <- result{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 // HandlerFactory returns a (you guessed it) handler function suitable for
 // passing to http.HandleFunc, which stores incoming request data using the
 // provided Dumper.
@@ -98,6 +180,7 @@ func HandlerFactory(d Dumper) func(http.ResponseWriter, *http.Request) {
 		// Get method, path, protocol, and all HTTP headers.
 		req.Head, err = httpu.DumpRequest(r, false)
 		if err != nil {
+			RequestsRejected.WithLabelValues("head").Inc()
 			log.Printf("%s\n", err)
 			http.Error(w, fmt.Sprintf("%s", err), http.StatusInternalServerError)
 			return
@@ -107,6 +190,7 @@ func HandlerFactory(d Dumper) func(http.ResponseWriter, *http.Request) {
 		defer r.Body.Close()
 		req.Data, err = iou.ReadAll(r.Body)
 		if err != nil {
+			RequestsRejected.WithLabelValues("body").Inc()
 			log.Printf("%s\n", err)
 			http.Error(w, fmt.Sprintf("%s", err), http.StatusInternalServerError)
 			return
@@ -114,12 +198,17 @@ func HandlerFactory(d Dumper) func(http.ResponseWriter, *http.Request) {
 
 		req.When = time.Now()
 
-		err = d.Dump(req)
+		if cd, ok := d.(ContextDumper); ok {
+			err = cd.DumpContext(r.Context(), req)
+		} else {
+			err = d.Dump(req)
+		}
 		if err != nil {
+			RequestsRejected.WithLabelValues("storage").Inc()
 			log.Printf("%s\n", err)
 			http.Error(w, fmt.Sprintf("%s", err), http.StatusInternalServerError)
 			return
 		}
-
+		RequestsDumped.Inc()
 	}
 }
@@ -0,0 +1,335 @@
+// Package storagetest provides a behavioral test suite that any storage.DumpBatcher
+// implementation should pass, so backends agree on ordering, batching and cleanup.
+//
+// A backend's own test file calls Run with a function that returns a new, empty store:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.DumpBatcher {
+//			d, err := NewDumper(t.TempDir())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return d
+//		})
+//	}
+//
+// Checks a backend can't pass by design are named in the call to Run, and skipped.
+// The pg backend stores heads and bodies in text columns, so it skips BinaryData:
+// PostgreSQL text can't hold NUL bytes or invalid UTF-8.
+package storagetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// Factory returns a new, empty DumpBatcher. It's called once per subtest.
+// If the returned value implements io.Closer, it's closed when the subtest ends.
+type Factory func(t *testing.T) storage.DumpBatcher
+
+// Run runs every conformance check against stores returned by newDB, except the ones named in skip.
+func Run(t *testing.T, newDB Factory, skip ...string) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.DumpBatcher)
+	}{
+		{"EmptyBatch", testEmptyBatch},
+		{"RoundTrip", testRoundTrip},
+		{"Ordering", testOrdering},
+		{"SeparateBatches", testSeparateBatches},
+		{"BatchDone", testBatchDone},
+		{"IdempotentBatchDone", testIdempotentBatchDone},
+		{"UnknownBatch", testUnknownBatch},
+		{"LargeBody", testLargeBody},
+		{"BinaryData", testBinaryData},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range skip {
+				if name == tt.name {
+					t.Skipf("%s isn't supported by this backend", name)
+				}
+			}
+			db := newDB(t)
+			if c, ok := db.(io.Closer); ok {
+				defer c.Close()
+			}
+			tt.fn(t, db)
+		})
+	}
+}
+
+// baseTime has no sub-second part, since some backends store whole seconds.
+var baseTime = time.Date(2015, 10, 27, 11, 23, 40, 0, time.UTC)
+
+func newRequest(n int) *storage.Request {
+	return &storage.Request{
+		Head: []byte(fmt.Sprintf("POST /%d HTTP/1.1\r\nHost: example.com\r\n\r\n", n)),
+		Data: []byte(fmt.Sprintf(`{"n":%d}`, n)),
+		When: baseTime.Add(time.Duration(n) * time.Second),
+	}
+}
+
+func dump(t *testing.T, db storage.DumpBatcher, reqs ...*storage.Request) {
+	t.Helper()
+	for _, req := range reqs {
+		if err := db.Dump(req); err != nil {
+			t.Fatalf("Dump: %s", err)
+		}
+	}
+}
+
+func markBatch(t *testing.T, db storage.DumpBatcher) int64 {
+	t.Helper()
+	batchID, err := db.MarkBatch()
+	if err != nil {
+		t.Fatalf("MarkBatch: %s", err)
+	}
+	return batchID
+}
+
+func readRequests(t *testing.T, db storage.DumpBatcher, batchID int64) []storage.Request {
+	t.Helper()
+	reqs, err := db.ReadRequests(batchID)
+	if err != nil {
+		t.Fatalf("ReadRequests(%d): %s", batchID, err)
+	}
+	return reqs
+}
+
+func batchDone(t *testing.T, db storage.DumpBatcher, batchID int64) {
+	t.Helper()
+	if err := db.BatchDone(batchID); err != nil {
+		t.Fatalf("BatchDone(%d): %s", batchID, err)
+	}
+}
+
+// checkSame fails unless got holds the same headers, body and timestamp as want.
+func checkSame(t *testing.T, got storage.Request, want *storage.Request) {
+	t.Helper()
+	if got.ID == nil {
+		t.Errorf("request has nil ID")
+	}
+	if !bytes.Equal(got.Head, want.Head) {
+		t.Errorf("Head = %q, want %q", truncate(got.Head), truncate(want.Head))
+	}
+	if !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("Data = %q, want %q", truncate(got.Data), truncate(want.Data))
+	}
+	if !got.When.Equal(want.When) {
+		t.Errorf("When = %s, want %s", got.When, want.When)
+	}
+}
+
+func truncate(buf []byte) []byte {
+	if len(buf) > 64 {
+		return buf[:64]
+	}
+	return buf
+}
+
+func testEmptyBatch(t *testing.T, db storage.DumpBatcher) {
+	if batchID := markBatch(t, db); batchID != 0 {
+		t.Fatalf("MarkBatch on an empty store = %d, want 0", batchID)
+	}
+	if reqs := readRequests(t, db, 0); len(reqs) != 0 {
+		t.Fatalf("ReadRequests(0) returned %d requests, want 0", len(reqs))
+	}
+}
+
+func testRoundTrip(t *testing.T, db storage.DumpBatcher) {
+	want := newRequest(1)
+	dump(t, db, want)
+
+	batchID := markBatch(t, db)
+	if batchID == 0 {
+		t.Fatalf("MarkBatch = 0 after Dump, want a batch")
+	}
+	reqs := readRequests(t, db, batchID)
+	if len(reqs) != 1 {
+		t.Fatalf("ReadRequests returned %d requests, want 1", len(reqs))
+	}
+	checkSame(t, reqs[0], want)
+}
+
+func testOrdering(t *testing.T, db storage.DumpBatcher) {
+	// Dump out of time order, to make sure requests come back sorted by When.
+	order := []int{3, 1, 4, 0, 5, 9, 2, 6, 8, 7}
+	for _, n := range order {
+		dump(t, db, newRequest(n))
+	}
+
+	reqs := readRequests(t, db, markBatch(t, db))
+	if len(reqs) != len(order) {
+		t.Fatalf("ReadRequests returned %d requests, want %d", len(reqs), len(order))
+	}
+	for i := range reqs {
+		checkSame(t, reqs[i], newRequest(i))
+	}
+}
+
+func testSeparateBatches(t *testing.T, db storage.DumpBatcher) {
+	dump(t, db, newRequest(0), newRequest(1), newRequest(2))
+	first := markBatch(t, db)
+	dump(t, db, newRequest(3), newRequest(4))
+	second := markBatch(t, db)
+
+	if first == 0 || second == 0 || first == second {
+		t.Fatalf("MarkBatch returned %d then %d, want two distinct batches", first, second)
+	}
+	if reqs := readRequests(t, db, first); len(reqs) != 3 {
+		t.Errorf("first batch has %d requests, want 3", len(reqs))
+	}
+	if reqs := readRequests(t, db, second); len(reqs) != 2 {
+		t.Errorf("second batch has %d requests, want 2", len(reqs))
+	}
+	if batchID := markBatch(t, db); batchID != 0 {
+		t.Errorf("MarkBatch with nothing pending = %d, want 0", batchID)
+	}
+}
+
+func testBatchDone(t *testing.T, db storage.DumpBatcher) {
+	dump(t, db, newRequest(0), newRequest(1))
+	first := markBatch(t, db)
+	dump(t, db, newRequest(2))
+	second := markBatch(t, db)
+
+	batchDone(t, db, first)
+	if reqs := readRequests(t, db, first); len(reqs) != 0 {
+		t.Errorf("finished batch still has %d requests", len(reqs))
+	}
+	if reqs := readRequests(t, db, second); len(reqs) != 1 {
+		t.Errorf("unfinished batch has %d requests, want 1", len(reqs))
+	}
+	if batchID := markBatch(t, db); batchID != 0 {
+		t.Errorf("MarkBatch after BatchDone = %d, want 0", batchID)
+	}
+}
+
+func testIdempotentBatchDone(t *testing.T, db storage.DumpBatcher) {
+	dump(t, db, newRequest(0))
+	batchID := markBatch(t, db)
+	batchDone(t, db, batchID)
+	batchDone(t, db, batchID)
+
+	// A later batch must be unaffected by repeating BatchDone.
+	dump(t, db, newRequest(1))
+	next := markBatch(t, db)
+	batchDone(t, db, batchID)
+	if reqs := readRequests(t, db, next); len(reqs) != 1 {
+		t.Errorf("batch after repeated BatchDone has %d requests, want 1", len(reqs))
+	}
+}
+
+func testUnknownBatch(t *testing.T, db storage.DumpBatcher) {
+	dump(t, db, newRequest(0))
+	batchID := markBatch(t, db)
+
+	unknown := batchID + 1000
+	if reqs := readRequests(t, db, unknown); len(reqs) != 0 {
+		t.Errorf("ReadRequests(%d) for an unknown batch returned %d requests", unknown, len(reqs))
+	}
+	batchDone(t, db, unknown)
+	if reqs := readRequests(t, db, batchID); len(reqs) != 1 {
+		t.Errorf("BatchDone for an unknown batch changed batch %d", batchID)
+	}
+}
+
+func testLargeBody(t *testing.T, db storage.DumpBatcher) {
+	want := newRequest(0)
+	want.Data = bytes.Repeat([]byte(`{"abc":123,"def":456}`), 200*1024)
+	dump(t, db, want)
+
+	reqs := readRequests(t, db, markBatch(t, db))
+	if len(reqs) != 1 {
+		t.Fatalf("ReadRequests returned %d requests, want 1", len(reqs))
+	}
+	checkSame(t, reqs[0], want)
+}
+
+func testBinaryData(t *testing.T, db storage.DumpBatcher) {
+	want := newRequest(0)
+	want.Data = make([]byte, 0, 512)
+	for i := 0; i < 512; i++ {
+		want.Data = append(want.Data, byte(i))
+	}
+	dump(t, db, want)
+
+	reqs := readRequests(t, db, markBatch(t, db))
+	if len(reqs) != 1 {
+		t.Fatalf("ReadRequests returned %d requests, want 1", len(reqs))
+	}
+	checkSame(t, reqs[0], want)
+}
+
+func testConcurrency(t *testing.T, db storage.DumpBatcher) {
+	const writers, perWriter = 8, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := db.Dump(newRequest(w*perWriter + i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Process batches while writers are still running, then drain what's left.
+	seen := map[int64]bool{}
+	process := func() int {
+		batchID := markBatch(t, db)
+		if batchID == 0 {
+			return 0
+		}
+		reqs := readRequests(t, db, batchID)
+		for _, req := range reqs {
+			if req.ID == nil {
+				t.Fatalf("request has nil ID")
+			}
+			if seen[*req.ID] {
+				t.Fatalf("request %d was returned in more than one batch", *req.ID)
+			}
+			seen[*req.ID] = true
+		}
+		batchDone(t, db, batchID)
+		return len(reqs)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			process()
+		}
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent Dump: %s", err)
+	}
+	for process() > 0 {
+	}
+
+	if len(seen) != writers*perWriter {
+		t.Fatalf("processed %d requests, want %d", len(seen), writers*perWriter)
+	}
+}